@@ -0,0 +1,210 @@
+package syncdb
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	//ErrAutoSyncRunning is returned by StartAutoSync when it is already running
+	ErrAutoSyncRunning = errors.New("Auto sync already running")
+)
+
+//SyncPolicy configure the background sync of StartAutoSync
+type SyncPolicy struct {
+	//Interval between syncs with all nodes, 5 minutes by default
+	Interval time.Duration
+	//Jitter is the max random time added to each interval, so nodes don't
+	//sync all at the same time
+	Jitter time.Duration
+	//Debounce is the wait after a local commit before sync, the commits
+	//in this time are sent together. Zero don't sync after commits
+	Debounce time.Duration
+	//MinBackoff is the wait before sync again with a node that failed,
+	//doubled at each failure up to MaxBackoff. 30 seconds and 30 minutes
+	//by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+//withDefaults return the policy with the zero values replaced by defaults
+func (p SyncPolicy) withDefaults() SyncPolicy {
+	if p.Interval <= 0 {
+		p.Interval = 5 * time.Minute
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = 30 * time.Second
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = 30 * time.Minute
+		if p.MaxBackoff < p.MinBackoff {
+			p.MaxBackoff = p.MinBackoff
+		}
+	}
+	return p
+}
+
+//next return the wait until the next periodic sync
+func (p SyncPolicy) next() time.Duration {
+	if p.Jitter <= 0 {
+		return p.Interval
+	}
+	return p.Interval + time.Duration(rand.Int63n(int64(p.Jitter)))
+}
+
+//peerBackoff is the wait of a node that failed to sync
+type peerBackoff struct {
+	wait  time.Duration
+	until time.Time
+}
+
+//syncBackoff hold the nodes that failed to sync, by address
+type syncBackoff struct {
+	min, max time.Duration
+	peers    map[string]*peerBackoff
+}
+
+//allow report if the node can be synced at now
+func (s *syncBackoff) allow(addr string, now time.Time) bool {
+	b, ok := s.peers[addr]
+	return !ok || !now.Before(b.until)
+}
+
+//retryAt return the earliest end of the backoffs, false without nodes in
+//backoff
+func (s *syncBackoff) retryAt() (time.Time, bool) {
+	var at time.Time
+	for _, b := range s.peers {
+		if at.IsZero() || b.until.Before(at) {
+			at = b.until
+		}
+	}
+	return at, !at.IsZero()
+}
+
+//retry report if the node is in backoff and it expired at now
+func (s *syncBackoff) retry(addr string, now time.Time) bool {
+	b, ok := s.peers[addr]
+	return ok && !now.Before(b.until)
+}
+
+//report record the result of the sync with the node at now, a failure
+//double its wait
+func (s *syncBackoff) report(addr string, err error, now time.Time) {
+	if err == nil {
+		delete(s.peers, addr)
+		return
+	}
+
+	b, ok := s.peers[addr]
+	if !ok {
+		b = &peerBackoff{wait: s.min}
+		s.peers[addr] = b
+	} else {
+		b.wait *= 2
+		if b.wait > s.max {
+			b.wait = s.max
+		}
+	}
+	b.until = now.Add(b.wait)
+	log.Println("Auto sync backoff", addr, b.wait)
+}
+
+//StartAutoSync sync with all nodes in background: now, at each interval
+//of policy and soon after the local commits. A node that fail is not
+//synced again until its backoff expire, and then it is retried without
+//wait the interval. It stop when ctx is canceled or the DB is closed,
+//Close wait it
+func (db *SyncDB) StartAutoSync(ctx context.Context, policy SyncPolicy) error {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+
+	if db.closed {
+		return ErrDBClosed
+	}
+	if db.autoStop != nil {
+		return ErrAutoSyncRunning
+	}
+	db.autoStop, db.autoDone = make(chan struct{}), make(chan struct{})
+
+	go db.runAutoSync(ctx, policy.withDefaults(), db.autoStop, db.autoDone)
+	return nil
+}
+
+//isClosed report if Close was called
+func (db *SyncDB) isClosed() bool {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+
+	return db.closed
+}
+
+func (db *SyncDB) runAutoSync(ctx context.Context, p SyncPolicy, stop, done chan struct{}) {
+	defer func() {
+		db.closeMu.Lock()
+		db.autoStop, db.autoDone = nil, nil
+		db.closeMu.Unlock()
+		close(done)
+	}()
+
+	//the sync in progress is canceled by Close
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := &syncBackoff{min: p.MinBackoff, max: p.MaxBackoff, peers: map[string]*peerBackoff{}}
+	allow := func(addr string) bool {
+		return backoff.allow(addr, time.Now())
+	}
+	retry := func(addr string) bool {
+		return backoff.retry(addr, time.Now())
+	}
+	report := func(addr string, err error) {
+		backoff.report(addr, err, time.Now())
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var debounce, retrying <-chan time.Time
+	for {
+		nodes := allow
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.committed:
+			if p.Debounce > 0 && debounce == nil {
+				debounce = time.After(p.Debounce)
+			}
+			continue
+		case <-debounce:
+			debounce = nil
+		case <-retrying:
+			//only the nodes in backoff, the others wait the interval
+			nodes = retry
+		case <-timer.C:
+			timer.Reset(p.next())
+		}
+
+		if db.isClosed() {
+			return
+		}
+		err := db.syncNodes(ctx, nodes, report)
+		if err != nil {
+			log.Println("Auto sync:", err)
+		}
+
+		retrying = nil
+		if at, ok := backoff.retryAt(); ok {
+			retrying = time.After(time.Until(at))
+		}
+	}
+}
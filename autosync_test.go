@@ -0,0 +1,188 @@
+package syncdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncBackoff(t *testing.T) {
+	b := &syncBackoff{min: time.Second, max: 3 * time.Second, peers: map[string]*peerBackoff{}}
+	now := time.Now()
+	fail := errors.New("fail")
+
+	if !b.allow("a", now) {
+		t.Error("Node without failures not allowed")
+	}
+
+	waits := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for _, wait := range waits {
+		b.report("a", fail, now)
+		if b.allow("a", now.Add(wait-time.Millisecond)) || !b.allow("a", now.Add(wait)) {
+			t.Error("Wrong backoff", wait, b.peers["a"].wait)
+		}
+	}
+	if !b.allow("b", now) {
+		t.Error("Backoff of other node")
+	}
+
+	//the retry is at the earliest end of the backoffs
+	b.report("b", fail, now)
+	if at, ok := b.retryAt(); !ok || !at.Equal(now.Add(time.Second)) {
+		t.Error("Wrong retry", at, ok)
+	}
+	if b.retry("b", now) || !b.retry("b", now.Add(time.Second)) || b.retry("c", now.Add(time.Second)) {
+		t.Error("Wrong nodes retried")
+	}
+
+	b.report("a", nil, now)
+	b.report("b", nil, now)
+	if !b.allow("a", now) {
+		t.Error("Backoff after success")
+	}
+	if _, ok := b.retryAt(); ok {
+		t.Error("Retry without backoff")
+	}
+}
+
+func TestAutoSync(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	//127.0.0.1 is skipped by Sync
+	db1.Discoverer = StaticDiscoverer{
+		node2: NodeInfo{IP: "localhost", Port: strconv.Itoa(db2.port)},
+		"bad": NodeInfo{IP: "localhost", Port: "1"}}
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := db1.StartAutoSync(ctx, SyncPolicy{Interval: time.Hour, Debounce: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db1.StartAutoSync(ctx, SyncPolicy{})
+	if err != ErrAutoSyncRunning {
+		t.Error("Auto sync started twice", err)
+	}
+
+	waitTxs := func(n string) bool {
+		for i := 0; i < 200; i++ {
+			if dump(t, db2, "select count(*) from __DBTX__") == `[["`+n+`"]]` {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	//the first sync is at start
+	if !waitTxs("1") {
+		t.Fatal("Auto sync not started")
+	}
+
+	//a commit is synced soon, without wait the interval
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+	if !waitTxs("2") {
+		t.Error("Commit not synced")
+	}
+
+	//it can be started again after stop
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 200; i++ {
+		err = db1.StartAutoSync(ctx, SyncPolicy{Interval: time.Hour})
+		if err != ErrAutoSyncRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Error("Auto sync not stopped", err)
+	}
+}
+
+func TestAutoSyncRetry(t *testing.T) {
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+
+	var attempts int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer bad.Close()
+	u, _ := url.Parse(bad.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	db.Discoverer = StaticDiscoverer{"bad": NodeInfo{IP: "localhost", Port: port}}
+
+	//the node is retried when the backoff expire, before the interval
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := db.StartAutoSync(ctx, SyncPolicy{Interval: time.Hour, MinBackoff: 20 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200 && atomic.LoadInt32(&attempts) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 3 {
+		t.Error("Node in backoff not retried", n)
+	}
+}
+
+func TestAutoSyncClose(t *testing.T) {
+	db := newTestNode(t, node1)
+
+	started := make(chan struct{}, 1)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	u, _ := url.Parse(hung.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	db.Discoverer = StaticDiscoverer{"hung": NodeInfo{IP: "localhost", Port: port}}
+
+	err := db.StartAutoSync(context.Background(), SyncPolicy{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := db.autoDone
+	<-started
+
+	//Close cancel the sync in progress and wait the auto sync
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = db.Close(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("Auto sync running after Close")
+	}
+}
@@ -0,0 +1,370 @@
+package syncdb
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+//driverName is the driver of the connections, it install an update hook
+//recording the tables changed by the write tx of each connection
+const driverName = "sqlite3_syncdb"
+
+var (
+	//hooked are the write txs by connection
+	hooksMu sync.Mutex
+	hooked  = map[*sqlite3.SQLiteConn]*Tx{}
+)
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{ConnectHook: func(c *sqlite3.SQLiteConn) error {
+		c.RegisterUpdateHook(func(op int, db, table string, rowid int64) {
+			hooksMu.Lock()
+			tx := hooked[c]
+			hooksMu.Unlock()
+			if tx != nil {
+				tx.rowChanged(table)
+			}
+		})
+		return nil
+	}})
+}
+
+//ChangeEvent is a tx committed in this node, local or received from a peer
+type ChangeEvent struct {
+	TxID string
+	//Origin is the id of the node that created the tx, empty for txs
+	//without origin stamp
+	Origin string
+	//Remote is true for txs received from Peer, the address of the node
+	//that sent it, empty when unknown
+	Remote   bool
+	Peer     string
+	Datetime string
+	HLC      string
+	//Tables changed by the tx: the tables of the rows changed, also by
+	//triggers, and of the statements
+	Tables []string
+	//Statements are the sqls logged, or the rows changed in LogRows mode.
+	//For remote txs only the ones applied, not the skipped by the resolver
+	Statements []SQLreg
+}
+
+//ChangeFilter select the events of a subscription, empty fields select all
+type ChangeFilter struct {
+	//Tables select the txs that change some of the tables
+	Tables []string
+	//Origins select the txs created by the nodes, by id
+	Origins []string
+	//RemoteOnly select only the txs received from other nodes
+	RemoteOnly bool
+}
+
+func (f ChangeFilter) match(ev ChangeEvent) bool {
+	if f.RemoteOnly && !ev.Remote {
+		return false
+	}
+
+	if len(f.Origins) > 0 {
+		found := false
+		for _, origin := range f.Origins {
+			found = found || origin == ev.Origin
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Tables) > 0 {
+		for _, table := range f.Tables {
+			for _, changed := range ev.Tables {
+				if strings.EqualFold(table, changed) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+//subscription queue the events of a subscriber, so a slow subscriber
+//don't block the commits
+type subscription struct {
+	filter ChangeFilter
+	ch     chan ChangeEvent
+
+	mu    sync.Mutex
+	queue []ChangeEvent
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (s *subscription) push(ev ChangeEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ev)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+//run deliver the queued events until stop, then close the channel
+func (s *subscription) run() {
+	defer close(s.ch)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case s.ch <- ev:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+//Subscribe return a channel with an event for each tx committed that
+//match the filter, delivered after the commit. The events are queued
+//while not received. The returned function cancel the subscription and
+//close the channel, as Close does
+func (db *SyncDB) Subscribe(filter ChangeFilter) (<-chan ChangeEvent, func()) {
+	s := &subscription{filter: filter, ch: make(chan ChangeEvent),
+		wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.run()
+
+	db.subsMu.Lock()
+	if db.subs == nil {
+		db.subs = map[*subscription]bool{}
+	}
+	db.subs[s] = true
+	db.subsMu.Unlock()
+
+	return s.ch, func() {
+		db.subsMu.Lock()
+		delete(db.subs, s)
+		db.subsMu.Unlock()
+		s.stop()
+	}
+}
+
+//subscribed report if there are subscriptions
+func (db *SyncDB) subscribed() bool {
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+
+	return len(db.subs) > 0
+}
+
+//publish send the event to the subscriptions it match
+func (db *SyncDB) publish(ev ChangeEvent) {
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+
+	for s := range db.subs {
+		if s.filter.match(ev) {
+			s.push(ev)
+		}
+	}
+}
+
+//unsubscribeAll cancel all subscriptions
+func (db *SyncDB) unsubscribeAll() {
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+
+	for s := range db.subs {
+		s.stop()
+	}
+	db.subs = nil
+}
+
+//localEvent return the event of the local tx being committed, it must be
+//in the transaction, after stampTx
+func (tx *Tx) localEvent() (ChangeEvent, error) {
+	ev := ChangeEvent{TxID: tx.idtx, Statements: tx.logged}
+	res, _, err := tx.Query("SELECT DATETIME, IFNULL(ORIGIN, ''), IFNULL(HLC, '') FROM __DBTX__ WHERE ID = ?",
+		[]interface{}{tx.idtx})
+	if err != nil {
+		return ev, err
+	}
+	if len(res) > 0 {
+		ev.Datetime, ev.Origin, ev.HLC = *res[0][0].(*string), *res[0][1].(*string), *res[0][2].(*string)
+	}
+	ev.Tables = tx.eventTables(ev.Statements)
+	return ev, nil
+}
+
+//remoteEvent return the event of the remote tx being applied, with the
+//statements applied
+func (tx *Tx) remoteEvent(remote txReg) ChangeEvent {
+	ev := ChangeEvent{TxID: remote.ID, Origin: remote.Origin, Remote: true, Datetime: remote.TxDatetime,
+		HLC: remote.HLC, Statements: append([]SQLreg{}, tx.applied...)}
+	ev.Tables = tx.eventTables(ev.Statements)
+	return ev
+}
+
+//rowChanged record the table of a row changed by the tx, the tables of
+//syncdb and SETTINGS are not of the application
+func (tx *Tx) rowChanged(table string) {
+	upper := strings.ToUpper(table)
+	if strings.HasPrefix(upper, "SQLITE_") || upper == "SETTINGS" ||
+		(len(table) >= 4 && strings.HasPrefix(table, "__") && strings.HasSuffix(table, "__")) {
+		return
+	}
+	for _, t := range tx.tables {
+		if strings.EqualFold(t, table) {
+			return
+		}
+	}
+	tx.tables = append(tx.tables, table)
+}
+
+//eventTables return the tables of the rows changed by the tx and then the
+//tables of the statements, the update hook don't see WITHOUT ROWID tables
+func (tx *Tx) eventTables(regs []SQLreg) []string {
+	tables := append([]string{}, tx.tables...)
+	for _, table := range changedTables(regs) {
+		found := false
+		for _, t := range tables {
+			found = found || strings.EqualFold(t, table)
+		}
+		if !found {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+//changedTables return the tables changed by the statements, once each
+func changedTables(regs []SQLreg) []string {
+	tables := []string{}
+	seen := map[string]bool{}
+	for _, reg := range regs {
+		for _, table := range changesetTables(reg.Changeset) {
+			if !seen[strings.ToLower(table)] {
+				seen[strings.ToLower(table)] = true
+				tables = append(tables, table)
+			}
+		}
+
+		table := ""
+		if reg.Row != nil {
+			table = reg.Row.Table
+		} else {
+			table = statementTable(reg.SQL)
+		}
+		if len(table) > 0 && !seen[strings.ToLower(table)] {
+			seen[strings.ToLower(table)] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+//statementTable return the table changed by the sql, empty when unknown
+func statementTable(sql string) string {
+	toks := tokenize(sql)
+	i := 0
+	next := func(s string) bool {
+		if i < len(toks) && toks[i].is(s) {
+			i++
+			return true
+		}
+		return false
+	}
+
+	//the common table expressions before the statement
+	if next("WITH") {
+		next("RECURSIVE")
+		for i < len(toks) {
+			i++
+			if i < len(toks) && toks[i].is("(") {
+				i = closing(toks, i) + 1
+			}
+			if !next("AS") {
+				return ""
+			}
+			next("NOT")
+			next("MATERIALIZED")
+			if i >= len(toks) || !toks[i].is("(") || closing(toks, i) < 0 {
+				return ""
+			}
+			i = closing(toks, i) + 1
+			if !next(",") {
+				break
+			}
+		}
+	}
+
+	switch {
+	case next("INSERT"), next("REPLACE"):
+		if next("OR") {
+			i++
+		}
+		if !next("INTO") {
+			return ""
+		}
+	case next("UPDATE"):
+		if next("OR") {
+			i++
+		}
+	case next("DELETE"):
+		if !next("FROM") {
+			return ""
+		}
+	case next("CREATE"):
+		if !next("TEMP") {
+			next("TEMPORARY")
+		}
+		if !next("TABLE") {
+			return ""
+		}
+		if next("IF") && !(next("NOT") && next("EXISTS")) {
+			return ""
+		}
+	case next("DROP"):
+		if !next("TABLE") {
+			return ""
+		}
+		if next("IF") && !next("EXISTS") {
+			return ""
+		}
+	case next("ALTER"):
+		if !next("TABLE") {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	if i >= len(toks) || toks[i].kind != tokIdent {
+		return ""
+	}
+	table := toks[i].text
+	if i+2 < len(toks) && toks[i+1].is(".") && toks[i+2].kind == tokIdent {
+		table = toks[i+2].text
+	}
+	return table
+}
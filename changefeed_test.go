@@ -0,0 +1,130 @@
+package syncdb
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, ch <-chan ChangeEvent) (ChangeEvent, bool) {
+	select {
+	case ev, ok := <-ch:
+		return ev, ok
+	case <-time.After(2 * time.Second):
+		t.Fatal("Event not received")
+	}
+	return ChangeEvent{}, false
+}
+
+func TestStatementTable(t *testing.T) {
+	cases := map[string]string{
+		"insert into foo values (1)":                                                            "foo",
+		"INSERT OR REPLACE INTO main.foo(id) VALUES (1)":                                        "foo",
+		"replace into \"Foo Bar\" values (1)":                                                   "Foo Bar",
+		"update or ignore foo set name = 'x'":                                                   "foo",
+		"delete from foo where id = 1":                                                          "foo",
+		"create table if not exists foo(id integer)":                                            "foo",
+		"create temp table foo(id integer)":                                                     "foo",
+		"drop table if exists foo":                                                              "foo",
+		"alter table foo add column name text":                                                  "foo",
+		"create index idx on foo(id)":                                                           "",
+		"with x as (select 1) insert into foo select * from x":                                  "foo",
+		"WITH RECURSIVE x(n) AS (SELECT 1), y AS NOT MATERIALIZED (SELECT (2)) DELETE FROM foo": "foo",
+	}
+	for sql, table := range cases {
+		if got := statementTable(sql); got != table {
+			t.Error("Wrong table", sql, got)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+
+	all, cancelAll := db2.Subscribe(ChangeFilter{})
+	defer cancelAll()
+	bar, cancelBar := db2.Subscribe(ChangeFilter{Tables: []string{"BAR"}})
+	defer cancelBar()
+	remote, cancelRemote := db2.Subscribe(ChangeFilter{Origins: []string{node1}, RemoteOnly: true})
+	defer cancelRemote()
+
+	tx, _ := db2.Begin()
+	tx.Exec("create table bar(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into bar values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	//rolled back txs have no event
+	tx, _ = db2.Begin()
+	tx.Exec("insert into bar values (2, ?)", []interface{}{"teste2"})
+	tx.Rollback()
+
+	tx, _ = db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+	err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, _ := nextEvent(t, all)
+	if ev.Remote || ev.Origin != node2 || len(ev.HLC) == 0 || len(ev.Datetime) == 0 ||
+		len(ev.Tables) != 1 || ev.Tables[0] != "bar" || len(ev.Statements) != 2 ||
+		ev.Statements[1].SQL != "insert into bar values (1, ?)" {
+		t.Error("Wrong local event", ev)
+	}
+	local := ev.TxID
+
+	ev, _ = nextEvent(t, all)
+	if !ev.Remote || ev.Origin != node1 || len(ev.Peer) == 0 || len(ev.Tables) != 1 || ev.Tables[0] != "foo" ||
+		len(ev.Statements) != 1 {
+		t.Error("Wrong remote event", ev)
+	}
+	ev2, _ := nextEvent(t, remote)
+	if ev2.TxID != ev.TxID {
+		t.Error("Wrong event of origin", ev2)
+	}
+
+	ev, _ = nextEvent(t, bar)
+	if ev.TxID != local {
+		t.Error("Wrong event of table", ev)
+	}
+
+	//Close end the subscriptions
+	db2.Close(context.Background())
+	for _, ch := range []<-chan ChangeEvent{all, bar, remote} {
+		if ev, ok := nextEvent(t, ch); ok {
+			t.Error("Unexpected event", ev)
+		}
+	}
+}
+
+func TestRemoteEventApplied(t *testing.T) {
+	db := newConflictNode(t, ResolverFunc(func(c *Conflict) Resolution {
+		return Resolution{Action: KeepLocal}
+	}))
+	defer db.Close(context.Background())
+	ch, cancel := db.Subscribe(ChangeFilter{RemoteOnly: true})
+	defer cancel()
+
+	err := db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-insert", HLC{Wall: 200}, node2, 2,
+		`{"SQL": "create table audit(name text)"}`,
+		`{"SQL": "create trigger foo_audit after insert on foo begin insert into audit values (new.name); end"}`,
+		`{"SQL": "insert into foo values (1, 'remote')"}`,
+		`{"SQL": "with x as (select 2) insert into foo select *, 'with' from x"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the statement skipped by KeepLocal is not in the event, the trigger
+	//write is
+	ev, _ := nextEvent(t, ch)
+	if len(ev.Statements) != 3 || ev.Statements[2].SQL != "with x as (select 2) insert into foo select *, 'with' from x" {
+		t.Error("Wrong statements", ev.Statements)
+	}
+	if len(ev.Tables) != 2 || ev.Tables[0] != "foo" || ev.Tables[1] != "audit" {
+		t.Error("Wrong tables", ev.Tables)
+	}
+}
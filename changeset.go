@@ -0,0 +1,539 @@
+//go:build sqlite_session
+// +build sqlite_session
+
+package syncdb
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+// the prototypes are of SQLite 3.25.2, of go-sqlite3 v1.10.0
+typedef struct sqlite3 sqlite3;
+typedef struct sqlite3_session sqlite3_session;
+typedef struct sqlite3_changeset_iter sqlite3_changeset_iter;
+typedef struct sqlite3_value sqlite3_value;
+typedef struct sqlite3_context sqlite3_context;
+
+int sqlite3session_create(sqlite3 *db, const char *zDb, sqlite3_session **ppSession);
+void sqlite3session_delete(sqlite3_session *pSession);
+void sqlite3session_table_filter(sqlite3_session *pSession, int (*xFilter)(void *pCtx, const char *zTab),
+	void *pCtx);
+int sqlite3session_attach(sqlite3_session *pSession, const char *zTab);
+int sqlite3session_changeset(sqlite3_session *pSession, int *pnChangeset, void **ppChangeset);
+int sqlite3changeset_apply(sqlite3 *db, int nChangeset, void *pChangeset,
+	int (*xFilter)(void *pCtx, const char *zTab),
+	int (*xConflict)(void *pCtx, int eConflict, sqlite3_changeset_iter *p), void *pCtx);
+int sqlite3changeset_start(sqlite3_changeset_iter **pp, int nChangeset, void *pChangeset);
+int sqlite3changeset_next(sqlite3_changeset_iter *pIter);
+int sqlite3changeset_op(sqlite3_changeset_iter *pIter, const char **pzTab, int *pnCol, int *pOp,
+	int *pbIndirect);
+int sqlite3changeset_pk(sqlite3_changeset_iter *pIter, unsigned char **pabPK, int *pnCol);
+int sqlite3changeset_old(sqlite3_changeset_iter *pIter, int iVal, sqlite3_value **ppValue);
+int sqlite3changeset_new(sqlite3_changeset_iter *pIter, int iVal, sqlite3_value **ppValue);
+int sqlite3changeset_finalize(sqlite3_changeset_iter *pIter);
+int sqlite3_value_type(sqlite3_value *v);
+long long sqlite3_value_int64(sqlite3_value *v);
+double sqlite3_value_double(sqlite3_value *v);
+const unsigned char *sqlite3_value_text(sqlite3_value *v);
+const void *sqlite3_value_blob(sqlite3_value *v);
+int sqlite3_value_bytes(sqlite3_value *v);
+void sqlite3_free(void *p);
+int sqlite3_auto_extension(void (*xEntryPoint)(void));
+int sqlite3_create_function(sqlite3 *db, const char *zFunctionName, int nArg, int eTextRep, void *pApp,
+	void (*xFunc)(sqlite3_context *, int, sqlite3_value **), void (*xStep)(sqlite3_context *, int, sqlite3_value **),
+	void (*xFinal)(sqlite3_context *));
+sqlite3 *sqlite3_context_db_handle(sqlite3_context *ctx);
+void sqlite3_result_int64(sqlite3_context *ctx, long long v);
+
+extern int changesetConflict(uintptr_t id, int kind, sqlite3_changeset_iter *it);
+
+// userTable select the tables of the application, as userObjects
+static inline int userTable(void *ctx, const char *name) {
+	size_t n = strlen(name);
+	if (strncasecmp(name, "sqlite_", 7) == 0 || strcasecmp(name, "SETTINGS") == 0) {
+		return 0;
+	}
+	return !(n >= 4 && strncmp(name, "__", 2) == 0 && strcmp(name + n - 2, "__") == 0);
+}
+
+static inline int createSession(sqlite3 *db, sqlite3_session **s) {
+	int rc = sqlite3session_create(db, "main", s);
+	if (rc != 0) {
+		return rc;
+	}
+	sqlite3session_table_filter(*s, userTable, 0);
+	rc = sqlite3session_attach(*s, 0);
+	if (rc != 0) {
+		sqlite3session_delete(*s);
+		*s = 0;
+	}
+	return rc;
+}
+
+static inline int conflictHandler(void *ctx, int kind, sqlite3_changeset_iter *it) {
+	return changesetConflict((uintptr_t)ctx, kind, it);
+}
+
+static inline int applyChangeset(sqlite3 *db, int n, void *p, uintptr_t id) {
+	return sqlite3changeset_apply(db, n, p, 0, conflictHandler, (void *)id);
+}
+
+// connHandle is the SQL function syncdb_handle(), the handle of the
+// connection running it
+static void connHandle(sqlite3_context *ctx, int n, sqlite3_value **v) {
+	sqlite3_result_int64(ctx, (long long)(intptr_t)sqlite3_context_db_handle(ctx));
+}
+
+static int registerHandle(sqlite3 *db, char **err, const void *api) {
+	return sqlite3_create_function(db, "syncdb_handle", 0, 1, 0, connHandle, 0, 0);
+}
+
+// autoHandle register syncdb_handle() in all the connections opened after
+static inline int autoHandle(void) {
+	return sqlite3_auto_extension((void (*)(void))registerHandle);
+}
+
+static inline sqlite3 *handleOf(long long h) {
+	return (sqlite3 *)(intptr_t)h;
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+//changesetSupported report if LogChangeset can be used. The session
+//extension is in the SQLite of go-sqlite3, but it is compiled only with
+//SQLITE_ENABLE_SESSION and SQLITE_ENABLE_PREUPDATE_HOOK:
+//
+//	CGO_CFLAGS="-DSQLITE_ENABLE_SESSION -DSQLITE_ENABLE_PREUPDATE_HOOK" go build -tags sqlite_session
+const changesetSupported = true
+
+//the codes of sqlite3changeset_op and of the conflict handler
+const (
+	opInsert = 18
+	opDelete = 9
+
+	conflictData       = 1
+	conflictNotFound   = 2
+	conflictRow        = 3
+	conflictConstraint = 4
+	conflictForeignKey = 5
+
+	changesetOmit    = 0
+	changesetReplace = 1
+	changesetAbort   = 2
+)
+
+//changeSession is a session recording the changes of a local tx
+type changeSession struct {
+	s *C.sqlite3_session
+}
+
+//go-sqlite3 has no accessor of the handle of its connections, so each
+//connection has syncdb_handle(), registered by an auto extension of SQLite
+func init() {
+	rc := C.autoHandle()
+	if rc != 0 {
+		log.Println("ERROR registering syncdb_handle", sqliteError(rc))
+	}
+}
+
+//raw call f with the connection of the write tx, reserved while f run
+func (tx *Tx) raw(f func(db *C.sqlite3) error) error {
+	var h int64
+	err := tx.tx.QueryRow("SELECT syncdb_handle()").Scan(&h)
+	if err != nil {
+		return err
+	}
+	return tx.conn.Raw(func(interface{}) error {
+		return f(C.handleOf(C.longlong(h)))
+	})
+}
+
+func sqliteError(rc C.int) error {
+	return sqlite3.Error{Code: sqlite3.ErrNo(rc & 0xff), ExtendedCode: sqlite3.ErrNoExtended(rc)}
+}
+
+//startSession start to record the changes of the tx, once
+func (tx *Tx) startSession() error {
+	if tx.session != nil {
+		return nil
+	}
+
+	return tx.raw(func(db *C.sqlite3) error {
+		var s *C.sqlite3_session
+		rc := C.createSession(db, &s)
+		if rc != 0 {
+			return sqliteError(rc)
+		}
+		tx.session = &changeSession{s: s}
+		return nil
+	})
+}
+
+//flushSession log the changes recorded by the session, as a changeset,
+//and end it
+func (tx *Tx) flushSession() error {
+	if tx.session == nil {
+		return nil
+	}
+
+	var b []byte
+	err := tx.raw(func(db *C.sqlite3) error {
+		var n C.int
+		var p unsafe.Pointer
+		rc := C.sqlite3session_changeset(tx.session.s, &n, &p)
+		if rc != 0 {
+			return sqliteError(rc)
+		}
+		if p != nil {
+			b = C.GoBytes(p, n)
+			C.sqlite3_free(p)
+		}
+		return nil
+	})
+	tx.endSession()
+	if err != nil || len(b) == 0 {
+		return err
+	}
+
+	return tx.logReg(SQLreg{Changeset: b})
+}
+
+//endSession discard the session
+func (tx *Tx) endSession() {
+	if tx.session != nil {
+		C.sqlite3session_delete(tx.session.s)
+		tx.session = nil
+	}
+}
+
+//goValue convert the sqlite value
+func goValue(v *C.sqlite3_value) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch C.sqlite3_value_type(v) {
+	case 1:
+		return int64(C.sqlite3_value_int64(v))
+	case 2:
+		return float64(C.sqlite3_value_double(v))
+	case 3:
+		p := unsafe.Pointer(C.sqlite3_value_text(v))
+		return C.GoStringN((*C.char)(p), C.sqlite3_value_bytes(v))
+	case 4:
+		p := C.sqlite3_value_blob(v)
+		return C.GoBytes(p, C.sqlite3_value_bytes(v))
+	}
+	return nil
+}
+
+//changesetChange is a change of a changeset: the table, the operation and
+//the key of the row, by column position
+type changesetChange struct {
+	table string
+	op    C.int
+	ncol  int
+	pos   []int
+	key   RowValues
+}
+
+//readChange read the change at the iterator
+func readChange(it *C.sqlite3_changeset_iter) changesetChange {
+	var tab *C.char
+	var ncol, op, indirect C.int
+	C.sqlite3changeset_op(it, &tab, &ncol, &op, &indirect)
+	ch := changesetChange{table: C.GoString(tab), op: op, ncol: int(ncol)}
+
+	var pk *C.uchar
+	C.sqlite3changeset_pk(it, &pk, &ncol)
+	pks := C.GoBytes(unsafe.Pointer(pk), ncol)
+	for i, isKey := range pks {
+		if isKey == 0 {
+			continue
+		}
+		var v *C.sqlite3_value
+		if op == opInsert {
+			C.sqlite3changeset_new(it, C.int(i), &v)
+		} else {
+			C.sqlite3changeset_old(it, C.int(i), &v)
+		}
+		ch.pos = append(ch.pos, i)
+		ch.key = append(ch.key, goValue(v))
+	}
+	return ch
+}
+
+//changesetChanges return the changes of the changeset
+func changesetChanges(changeset []byte) ([]changesetChange, error) {
+	if len(changeset) == 0 {
+		return nil, nil
+	}
+
+	p := C.CBytes(changeset)
+	defer C.free(p)
+
+	var it *C.sqlite3_changeset_iter
+	rc := C.sqlite3changeset_start(&it, C.int(len(changeset)), p)
+	if rc != 0 {
+		return nil, sqliteError(rc)
+	}
+
+	ret := []changesetChange{}
+	for C.sqlite3changeset_next(it) == 100 {
+		ret = append(ret, readChange(it))
+	}
+	rc = C.sqlite3changeset_finalize(it)
+	if rc != 0 {
+		return nil, sqliteError(rc)
+	}
+	return ret, nil
+}
+
+//changesetTables return the tables changed by the changeset, once each
+func changesetTables(changeset []byte) []string {
+	changes, err := changesetChanges(changeset)
+	if err != nil {
+		return nil
+	}
+
+	tables := []string{}
+	seen := map[string]bool{}
+	for _, ch := range changes {
+		if !seen[ch.table] {
+			seen[ch.table] = true
+			tables = append(tables, ch.table)
+		}
+	}
+	return tables
+}
+
+//changesetApply is the state of a changeset being applied: the actions
+//chosen for the rows in conflict, and the first conflict without action
+type changesetApply struct {
+	actions map[string]C.int
+	kind    C.int
+	pending *changesetChange
+}
+
+//rowID identify the row of the change
+func (ch changesetChange) rowID() string {
+	b, _ := json.Marshal(ch.key)
+	return ch.table + "\x00" + string(b)
+}
+
+var (
+	appliesMu sync.Mutex
+	applies   = map[uintptr]*changesetApply{}
+	lastApply uintptr
+)
+
+//changesetConflict is the conflict handler of sqlite3changeset_apply. It
+//return the action chosen for the row, or abort the apply to resolve it
+//
+//export changesetConflict
+func changesetConflict(id C.uintptr_t, kind C.int, it *C.sqlite3_changeset_iter) C.int {
+	appliesMu.Lock()
+	a := applies[uintptr(id)]
+	appliesMu.Unlock()
+
+	//the foreign keys are checked at the end, without row
+	if kind == conflictForeignKey {
+		a.kind, a.pending = kind, &changesetChange{}
+		return changesetAbort
+	}
+
+	ch := readChange(it)
+	action, ok := a.actions[ch.rowID()]
+	if ok && (action != changesetReplace || kind == conflictData || kind == conflictRow) {
+		return action
+	}
+	a.kind, a.pending = kind, &ch
+	return changesetAbort
+}
+
+//changesetConflictErr return the error of the conflict kind
+func changesetConflictErr(kind C.int) error {
+	switch kind {
+	case conflictData:
+		return ErrRowChanged
+	case conflictNotFound:
+		return ErrRowNotFound
+	case conflictRow:
+		return ErrRowExists
+	}
+	return sqlite3.Error{Code: sqlite3.ErrConstraint}
+}
+
+//checkChangeset verify that the tables of the changeset exist with the
+//same columns, the changes to other tables would be ignored
+func (tx *Tx) checkChangeset(changeset []byte) error {
+	changes, err := changesetChanges(changeset)
+	if err != nil {
+		return err
+	}
+
+	ncols := map[string]int{}
+	for _, ch := range changes {
+		ncol, ok := ncols[ch.table]
+		if !ok {
+			info, err := tx.tableInfo(ch.table)
+			if err != nil {
+				return err
+			}
+			for _, col := range info.cols {
+				if col != "rowid" {
+					ncol++
+				}
+			}
+			ncols[ch.table] = ncol
+		}
+		if ncol != ch.ncol {
+			return errors.New("table " + ch.table + " of the changeset not found with " +
+				strconv.Itoa(ch.ncol) + " columns")
+		}
+	}
+	return nil
+}
+
+//applyChangeset apply the changeset, all or nothing. The conflicts are
+//resolved one by one: the apply stop at a conflict, the resolver choose
+//the action for the row and the apply start again. Logged changesets are
+//recorded again in the current tx
+func (tx *Tx) applyChangeset(reg SQLreg, logged bool) error {
+	err := tx.checkChangeset(reg.Changeset)
+	if err != nil {
+		return err
+	}
+
+	a := &changesetApply{actions: map[string]C.int{}}
+	appliesMu.Lock()
+	lastApply++
+	id := lastApply
+	applies[id] = a
+	appliesMu.Unlock()
+	defer func() {
+		appliesMu.Lock()
+		delete(applies, id)
+		appliesMu.Unlock()
+	}()
+
+	merges := []SQLreg{}
+	for {
+		a.pending = nil
+		err = tx.raw(func(db *C.sqlite3) error {
+			rc := C.applyChangeset(db, C.int(len(reg.Changeset)), unsafe.Pointer(&reg.Changeset[0]),
+				C.uintptr_t(id))
+			if rc != 0 {
+				return sqliteError(rc)
+			}
+			return nil
+		})
+		if a.pending == nil {
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		action, merge, err := tx.resolveChangeset(reg, a)
+		if err != nil {
+			return err
+		}
+		a.actions[a.pending.rowID()] = action
+		merges = append(merges, merge...)
+	}
+
+	if tx.remote {
+		tx.applied = append(tx.applied, reg)
+	}
+	for _, m := range merges {
+		err = tx.applyReg(m, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if logged {
+		return tx.logReg(reg)
+	}
+	return nil
+}
+
+//resolveChangeset return the action of the resolver for the pending
+//conflict, Reject without resolver. Rejected conflicts are returned as
+//errors, and deferred ones as errTxDeferred
+func (tx *Tx) resolveChangeset(reg SQLreg, a *changesetApply) (C.int, []SQLreg, error) {
+	ch := a.pending
+	c := &Conflict{TxID: tx.idtx, Statement: reg, Err: changesetConflictErr(a.kind), Table: ch.table}
+	rejected := errors.New("table " + ch.table + ": " + c.Err.Error())
+	if len(ch.table) == 0 {
+		rejected = c.Err
+	}
+	_, decided := a.actions[ch.rowID()]
+	if !tx.remote || decided || a.kind == conflictForeignKey {
+		return 0, nil, rejected
+	}
+
+	res, _, err := tx.Query("SELECT IFNULL(ORIGIN, ''), IFNULL(HLC, ''), IFNULL(DATETIME, '') FROM __DBTX__ WHERE ID = ?",
+		[]interface{}{tx.idtx})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(res) > 0 {
+		c.Origin, c.HLC, c.TxDatetime = *res[0][0].(*string), *res[0][1].(*string), *res[0][2].(*string)
+	}
+
+	//the local row has the key of the change
+	info, err := tx.tableInfo(ch.table)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.Cols = info.cols
+	if a.kind == conflictData || a.kind == conflictRow {
+		conds := []string{}
+		for i, pos := range ch.pos {
+			conds = append(conds, quoteIdent(info.cols[pos])+" IS ?"+strconv.Itoa(i+1))
+		}
+		c.where, c.params = strings.Join(conds, " AND "), []interface{}(ch.key)
+		err = tx.selectLocalRows(c, info)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	resolution := Resolution{Action: Reject}
+	if tx.db.Resolver != nil {
+		resolution = tx.db.Resolver.Resolve(c)
+	}
+
+	switch resolution.Action {
+	case Defer:
+		return 0, nil, errTxDeferred
+	case KeepLocal:
+		return changesetOmit, nil, nil
+	case Merge:
+		return changesetOmit, resolution.Merge, nil
+	case TakeRemote:
+		switch a.kind {
+		case conflictData, conflictRow:
+			return changesetReplace, nil, nil
+		case conflictNotFound:
+			//the row is not in this node, the changed columns are not a row
+			return changesetOmit, nil, nil
+		}
+	}
+	return 0, nil, rejected
+}
@@ -0,0 +1,31 @@
+//go:build !sqlite_session
+// +build !sqlite_session
+
+package syncdb
+
+//changesetSupported report if LogChangeset can be used, only with the
+//sqlite_session build tag
+const changesetSupported = false
+
+type changeSession struct{}
+
+func (tx *Tx) startSession() error {
+	return ErrChangesetNotSupported
+}
+
+func (tx *Tx) flushSession() error {
+	return nil
+}
+
+func (tx *Tx) endSession() {
+}
+
+//applyChangeset fail, a node without session extension can't apply the
+//changesets received
+func (tx *Tx) applyChangeset(reg SQLreg, logged bool) error {
+	return ErrChangesetNotSupported
+}
+
+func changesetTables(changeset []byte) []string {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !sqlite_session
+// +build !sqlite_session
+
+package syncdb
+
+import "testing"
+
+func TestLogChangesetNotSupported(t *testing.T) {
+	_, err := NewWithOptions(":memory:", Options{DisableServer: true, LogMode: LogChangeset})
+	if err != ErrChangesetNotSupported {
+		t.Error("Expected ErrChangesetNotSupported", err)
+	}
+}
@@ -0,0 +1,168 @@
+//go:build sqlite_session
+// +build sqlite_session
+
+package syncdb
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newChangesetNodes(t *testing.T, resolver ConflictResolver) (*SyncDB, *SyncDB) {
+	nodes := []*SyncDB{}
+	for _, id := range []string{node1, node2} {
+		db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0", LogMode: LogChangeset,
+			Resolver: resolver})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, _ := db.Begin()
+		tx.Set("id", id)
+		tx.Commit()
+		nodes = append(nodes, db)
+	}
+	db1, db2 := nodes[0], nodes[1]
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, 'a'), (2, 'b'), (3, 'c')", []interface{}{})
+	tx.Commit()
+
+	err := db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db1, db2
+}
+
+func TestLogChangeset(t *testing.T) {
+	db1, db2 := newChangesetNodes(t, nil)
+	defer db1.Close(context.Background())
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("update foo set name = name || random() where id < 3", []interface{}{})
+	tx.Exec("delete from foo where id = 3", []interface{}{})
+	tx.ExecRow(RowChange{Op: "INSERT", Table: "foo", Cols: []string{"id", "name"}, Key: []string{"id"},
+		New: RowValues{4, "d"}})
+	err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql := "select * from foo order by id"
+	if d1, d2 := dump(t, db1, sql), dump(t, db2, sql); d1 != d2 {
+		t.Error("Different contents", d1, d2)
+	}
+
+	//the changes of the tx are one changeset
+	n := dump(t, db1, "select count(*) from __DBLOG__ where txid = '"+tx.idtx+"' and sql like '%Changeset%'")
+	if n != `[["1"]]` {
+		t.Error("Expected one changeset", n)
+	}
+}
+
+func TestLogChangesetConflict(t *testing.T) {
+	cases := []struct {
+		resolver ConflictResolver
+		name     string
+		rejected bool
+	}{
+		{nil, "local", true},
+		{ResolverFunc(func(c *Conflict) Resolution {
+			if c.Err != ErrRowChanged || c.Table != "foo" || len(c.Local) != 1 {
+				t.Error("Wrong conflict", c)
+			}
+			return Resolution{Action: KeepLocal}
+		}), "local", false},
+		{ResolverFunc(func(c *Conflict) Resolution {
+			return Resolution{Action: TakeRemote}
+		}), "remote", false},
+	}
+
+	for i, cs := range cases {
+		db1, db2 := newChangesetNodes(t, cs.resolver)
+		defer db1.Close(context.Background())
+		defer db2.Close(context.Background())
+
+		tx, _ := db2.Begin()
+		tx.Exec("update foo set name = 'local' where id = 1", []interface{}{})
+		tx.Commit()
+
+		tx, _ = db1.Begin()
+		tx.Exec("update foo set name = 'remote' where id = 1", []interface{}{})
+		tx.Exec("update foo set name = 'x' where id = 2", []interface{}{})
+		tx.Commit()
+
+		err := db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+		if cs.rejected != (err != nil) {
+			t.Error("Unexpected result", i, err)
+		}
+
+		want := `[["` + cs.name + `"],["x"]]`
+		if cs.rejected {
+			want = `[["local"],["b"]]`
+		}
+		if names := dump(t, db2, "select name from foo where id < 3 order by id"); names != want {
+			t.Error("Wrong resolution", i, names, want)
+		}
+		quarantined, err := db2.QuarantinedTxs()
+		if err != nil || (len(quarantined) == 1) != cs.rejected {
+			t.Error("Wrong quarantine", i, quarantined, err)
+		}
+		if cs.rejected && len(quarantined) == 1 && !strings.Contains(quarantined[0].Statement, `"Changeset"`) {
+			t.Error("Changeset not in quarantine", quarantined[0].Statement)
+		}
+	}
+}
+
+func TestLogChangesetWithoutKey(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, LogMode: LogChangeset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	defer tx.Rollback()
+	err = tx.Exec("create table bar(name text)", []interface{}{})
+	if err != ErrNoPrimaryKey {
+		t.Error("Expected ErrNoPrimaryKey", err)
+	}
+}
+
+func TestConnHandle(t *testing.T) {
+	arq, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(arq)
+	db, err := NewWithOptions(arq, Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	//each connection give its own handle
+	handles := map[int64]bool{}
+	for _, pool := range []*sql.DB{db.sqlite, db.readers} {
+		var h int64
+		err = pool.QueryRow("SELECT syncdb_handle()").Scan(&h)
+		if err != nil || h == 0 {
+			t.Fatal("Wrong handle", h, err)
+		}
+		handles[h] = true
+	}
+	if len(handles) != 2 {
+		t.Error("Same handle of different connections", handles)
+	}
+}
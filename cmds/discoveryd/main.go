@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/trumae/syncdb"
+)
+
+var (
+	DB  *sql.DB
+	ttl time.Duration
+	//token authorize the management of rum scripts, that run in all nodes
+	token string
+)
+
+func main() {
+	filedb := ""
+	flag.StringVar(&filedb, "db", "discovery.db", "registry database file")
+
+	addr := ""
+	flag.StringVar(&addr, "addr", ":8080", "listen address")
+
+	flag.DurationVar(&ttl, "ttl", 15*time.Minute, "time until a node registration expire")
+
+	flag.StringVar(&token, "token", os.Getenv("DISCOVERYD_TOKEN"),
+		"token to manage rum scripts (Authorization: Bearer <token>), default $DISCOVERYD_TOKEN; "+
+			"without it /rum is disabled")
+
+	flag.Parse()
+
+	var err error
+	DB, err = openRegistry(filedb)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		for {
+			err := expireNodes()
+			if err != nil {
+				log.Println(err)
+			}
+			time.Sleep(ttl)
+		}
+	}()
+
+	http.HandleFunc("/", handleDiscover)
+	http.HandleFunc("/rum", handleRum)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func openRegistry(arq string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", arq)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS NODES (COMPANY TEXT NOT NULL,
+		ID TEXT NOT NULL,
+		IP TEXT NOT NULL,
+		PORT TEXT NOT NULL,
+		LASTSEEN INTEGER NOT NULL,
+		PRIMARY KEY (COMPANY, ID))`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS RUM (COMPANY TEXT NOT NULL,
+		ID TEXT NOT NULL,
+		SCRIPT TEXT NOT NULL,
+		PRIMARY KEY (COMPANY, ID))`)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+//expireNodes remove registrations not renewed in ttl
+func expireNodes() error {
+	_, err := DB.Exec("DELETE FROM NODES WHERE LASTSEEN < ?", time.Now().Add(-ttl).Unix())
+	return err
+}
+
+//registerNode insert or refresh the node registration
+func registerNode(company, id, ips, port string) error {
+	_, err := DB.Exec(`INSERT OR REPLACE INTO NODES(COMPANY, ID, IP, PORT, LASTSEEN)
+		VALUES (?, ?, ?, ?, ?)`, company, id, ips, port, time.Now().Unix())
+	return err
+}
+
+//companyNodes return the live nodes of company with theirs rum scripts
+func companyNodes(company string) (map[string]syncdb.NodeInfo, error) {
+	rows, err := DB.Query(`SELECT N.ID, N.IP, N.PORT, IFNULL(R.SCRIPT, '')
+		FROM NODES N LEFT JOIN RUM R ON R.COMPANY = N.COMPANY AND R.ID = N.ID
+		WHERE N.COMPANY = ? AND N.LASTSEEN >= ?`, company, time.Now().Add(-ttl).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := map[string]syncdb.NodeInfo{}
+	for rows.Next() {
+		var id string
+		node := syncdb.NodeInfo{}
+		err = rows.Scan(&id, &node.IP, &node.Port, &node.Rum)
+		if err != nil {
+			return nil, err
+		}
+		nodes[id] = node
+	}
+
+	return nodes, rows.Err()
+}
+
+//handleDiscover register the node and return the nodes of its company
+func handleDiscover(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	company := q.Get("c")
+	id := q.Get("id")
+	ips := q.Get("i")
+	port := q.Get("p")
+
+	if len(company) == 0 || len(id) == 0 {
+		http.Error(w, "c and id are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	err := registerNode(company, id, ips, port)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes, err := companyNodes(company)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+//authorized report if the request carry the token. Without token nobody
+//is authorized
+func authorized(r *http.Request) bool {
+	if len(token) == 0 {
+		return false
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) == 1
+}
+
+//handleRum attach (PUT/POST), show (GET) or remove (DELETE) the rum script
+//of a node. The scripts run in the nodes, so only the holders of the token
+//manage them
+func handleRum(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	company := q.Get("c")
+	id := q.Get("id")
+
+	if len(company) == 0 || len(id) == 0 {
+		http.Error(w, "c and id are required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		script := ""
+		err := DB.QueryRow("SELECT SCRIPT FROM RUM WHERE COMPANY = ? AND ID = ?",
+			company, id).Scan(&script)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(script))
+
+	case http.MethodPut, http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = syncdb.RumParse(string(body))
+		if err != nil {
+			http.Error(w, "invalid rum script: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = DB.Exec("INSERT OR REPLACE INTO RUM(COMPANY, ID, SCRIPT) VALUES (?, ?, ?)",
+			company, id, string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		_, err := DB.Exec("DELETE FROM RUM WHERE COMPANY = ? AND ID = ?", company, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trumae/syncdb"
+)
+
+func openTestRegistry(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "discoveryd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB, err = openRegistry(filepath.Join(dir, "discovery.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	ttl, token = time.Minute, "secret"
+	return func() {
+		DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func request(t *testing.T, handler http.HandlerFunc, method, url, auth, body string) (int, string) {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if len(auth) > 0 {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestDiscover(t *testing.T) {
+	defer openTestRegistry(t)()
+
+	code, _ := request(t, handleDiscover, http.MethodGet, "/?c=company1&id=node1&i=10.0.0.1&p=x", "", "")
+	if code != http.StatusBadRequest {
+		t.Error("Invalid port accepted", code)
+	}
+
+	request(t, handleDiscover, http.MethodGet, "/?c=company1&id=node1&i=10.0.0.1&p=12345", "", "")
+	request(t, handleDiscover, http.MethodGet, "/?c=company2&id=node3&i=10.0.0.3&p=12345", "", "")
+	code, body := request(t, handleDiscover, http.MethodGet, "/?c=company1&id=node2&i=10.0.0.2&p=12346", "", "")
+	if code != http.StatusOK {
+		t.Fatal("Wrong status", code, body)
+	}
+
+	nodes := map[string]syncdb.NodeInfo{}
+	err := json.Unmarshal([]byte(body), &nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes["node1"].IP != "10.0.0.1" || nodes["node2"].Port != "12346" {
+		t.Error("Wrong nodes", nodes)
+	}
+}
+
+func TestRum(t *testing.T) {
+	defer openTestRegistry(t)()
+	url := "/rum?c=company1&id=node1"
+	auth := "Bearer secret"
+
+	code, _ := request(t, handleRum, http.MethodPut, url, auth, "(print 1")
+	if code != http.StatusBadRequest {
+		t.Error("Invalid script accepted", code)
+	}
+
+	code, _ = request(t, handleRum, http.MethodPut, url, auth, "(print 1)")
+	if code != http.StatusNoContent {
+		t.Fatal("Script not attached", code)
+	}
+	code, body := request(t, handleRum, http.MethodGet, url, auth, "")
+	if code != http.StatusOK || body != "(print 1)" {
+		t.Error("Wrong script", code, body)
+	}
+
+	//the node receive its script
+	_, body = request(t, handleDiscover, http.MethodGet, "/?c=company1&id=node1&i=10.0.0.1&p=12345", "", "")
+	if !strings.Contains(body, `"Rum":"(print 1)"`) {
+		t.Error("Script not discovered", body)
+	}
+
+	code, _ = request(t, handleRum, http.MethodDelete, url, auth, "")
+	if code != http.StatusNoContent {
+		t.Error("Script not removed", code)
+	}
+	code, _ = request(t, handleRum, http.MethodGet, url, auth, "")
+	if code != http.StatusNotFound {
+		t.Error("Removed script found", code)
+	}
+}
+
+func TestRumUnauthorized(t *testing.T) {
+	defer openTestRegistry(t)()
+	url := "/rum?c=company1&id=node1"
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete} {
+			code, _ := request(t, handleRum, method, url, auth, "(print 1)")
+			if code != http.StatusUnauthorized {
+				t.Error("Request without token accepted", method, auth, code)
+			}
+		}
+	}
+
+	var n int
+	DB.QueryRow("SELECT COUNT(*) FROM RUM").Scan(&n)
+	if n != 0 {
+		t.Error("Script attached without token", n)
+	}
+
+	//without token configured nobody manage the scripts
+	token = ""
+	code, _ := request(t, handleRum, http.MethodPut, url, "Bearer ", "(print 1)")
+	if code != http.StatusUnauthorized {
+		t.Error("Request accepted without token configured", code)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/trumae/syncdb"
@@ -18,24 +22,56 @@ func main() {
 	node := ""
 	flag.StringVar(&node, "node", "id1", "node id")
 
+	listen := ""
+	flag.StringVar(&listen, "listen", "", "sync server listen address, like :12345")
+
+	advertise := ""
+	flag.StringVar(&advertise, "advertise", "", "address announced to other nodes")
+
+	lan := false
+	flag.BoolVar(&lan, "lan", false, "discover nodes on LAN by udp multicast")
+
+	interval := time.Duration(0)
+	flag.DurationVar(&interval, "interval", 300*time.Second, "interval between syncs")
+
 	flag.Parse()
 
-	db1, err := syncdb.New(filedb)
+	db1, err := syncdb.NewWithOptions(filedb, syncdb.Options{
+		ListenAddr:    listen,
+		AdvertiseAddr: advertise})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if lan {
+		db1.Discoverer = &syncdb.MulticastDiscoverer{}
+	}
+
+	tx, err := db1.Begin()
 	if err != nil {
 		log.Fatal(err)
 	}
+	tx.Set("company", company)
+	tx.Set("id", node)
+	tx.Commit()
 
-	db1.Begin()
-	db1.Set("company", company)
-	db1.Set("id", node)
-	db1.Commit()
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db1.StartAutoSync(ctx, syncdb.SyncPolicy{
+		Interval: interval,
+		Jitter:   interval / 10,
+		Debounce: 2 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for {
-		err = db1.Sync()
-		if err != nil {
-			log.Fatal(err)
-		}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	cancel()
 
-		time.Sleep(300 * time.Second)
+	ctx, cancelClose := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelClose()
+	err = db1.Close(ctx)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -32,13 +33,16 @@ Now: {{ .Now "Monday, 2 Jan 2006" }}
 `
 
 var (
-	DB   *syncdb.SyncDB
-	inTx bool
+	DB *syncdb.SyncDB
+	//Tx is the transaction open by begin, nil out of a transaction
+	Tx *syncdb.Tx
 )
 
 func main() {
 	filedb := "store.db"
 	flag.StringVar(&filedb, "db", "store.db", "database path")
+	listen := ""
+	flag.StringVar(&listen, "listen", "", "sync server listen address, like :12345")
 	flag.Parse()
 
 	isEnabled := true
@@ -56,7 +60,7 @@ func main() {
 	}
 	defer rl.Close()
 
-	DB, err = syncdb.New(filedb)
+	DB, err = syncdb.NewWithOptions(filedb, syncdb.Options{ListenAddr: listen})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -93,6 +97,9 @@ get <key>               Read a key an setting
 set <key> <val>         write a key/value an settings
 gset <key> <val>        write a key/value an settings(global)
 sync                    Sync db with nodes
+quarantine              List remote txs failed to apply
+retry <tx id>           Apply again a tx in quarantine
+discard <tx id>         Give up a tx in quarantine, without apply it
 begin                   Init transaction
 commit                  Finish transaction with success
 rollback                Finish transaction with fail
@@ -104,11 +111,33 @@ schema <table name>     Show table schema
 `
 }
 
+//currentTx return the transaction open by begin, or a new one finished
+//by done
+func currentTx(query bool) (tx *syncdb.Tx, done func(), err error) {
+	if Tx != nil {
+		return Tx, func() {}, nil
+	}
+
+	if query {
+		tx, err = DB.BeginForQuery()
+	} else {
+		tx, err = DB.Begin()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, func() { tx.Commit() }, nil
+}
+
 func processCmd(cmd string) string {
 	fcmd := strings.TrimSpace(cmd[:len(cmd)-1])
 	upcmd := strings.ToUpper(fcmd)
 	switch {
 	case strings.HasPrefix(upcmd, "QUIT") || strings.HasPrefix(upcmd, "EXIT"):
+		if Tx != nil {
+			Tx.Rollback()
+		}
+		DB.Close(context.Background())
 		os.Exit(0)
 
 	case strings.HasPrefix(upcmd, "HELP"):
@@ -120,14 +149,15 @@ func processCmd(cmd string) string {
 			return "usage: set <key> <val>;"
 		}
 
-		if !inTx {
-			DB.Begin()
-			defer DB.Commit()
+		tx, done, err := currentTx(false)
+		if err != nil {
+			return "Error in begin " + err.Error()
 		}
+		defer done()
 
 		key := params[1]
 		val := params[2]
-		err := DB.Set(key, val)
+		err = tx.Set(key, val)
 		if err != nil {
 			return "Error write setting " + err.Error()
 		}
@@ -140,14 +170,15 @@ func processCmd(cmd string) string {
 			return "usage: gset <key> <val>;"
 		}
 
-		if !inTx {
-			DB.Begin()
-			defer DB.Commit()
+		tx, done, err := currentTx(false)
+		if err != nil {
+			return "Error in begin " + err.Error()
 		}
+		defer done()
 
 		key := params[1]
 		val := params[2]
-		err := DB.GSet(key, val)
+		err = tx.GSet(key, val)
 		if err != nil {
 			return "Error write setting " + err.Error()
 		}
@@ -161,13 +192,14 @@ func processCmd(cmd string) string {
 			return "usage: get <key>;"
 		}
 
-		if !inTx {
-			DB.Begin()
-			defer DB.Commit()
+		tx, done, err := currentTx(true)
+		if err != nil {
+			return "Error in begin " + err.Error()
 		}
+		defer done()
 
 		key := params[1]
-		val, err := DB.Get(key)
+		val, err := tx.Get(key)
 		if err != nil {
 			return "Error read setting " + err.Error()
 		}
@@ -181,10 +213,57 @@ func processCmd(cmd string) string {
 		}
 		return "Done"
 
+	case strings.HasPrefix(upcmd, "QUARANTINE"):
+		if Tx != nil {
+			return "Not allowed in a transaction"
+		}
+		txs, err := DB.QuarantinedTxs()
+		if err != nil {
+			return "Error reading quarantine " + err.Error()
+		}
+
+		ret := "| ID | ORIGIN | PEER | ATTEMPTS | LASTSEEN | STATEMENT | ERROR |"
+		for _, tx := range txs {
+			ret += fmt.Sprintf("\n| %s | %s | %s | %d | %s | %s | %s |", tx.ID, tx.Origin, tx.Peer,
+				tx.Attempts, tx.LastSeen, tx.Statement, tx.Error)
+		}
+		return ret
+
+	case strings.HasPrefix(upcmd, "RETRY"):
+		params := strings.Fields(fcmd)
+		if len(params) != 2 {
+			return "usage: retry <tx id>;"
+		}
+		if Tx != nil {
+			return "Not allowed in a transaction"
+		}
+		err := DB.RetryQuarantined(params[1])
+		if err != nil {
+			return "Error in retry " + err.Error()
+		}
+		return "Done"
+
+	case strings.HasPrefix(upcmd, "DISCARD"):
+		params := strings.Fields(fcmd)
+		if len(params) != 2 {
+			return "usage: discard <tx id>;"
+		}
+		if Tx != nil {
+			return "Not allowed in a transaction"
+		}
+		err := DB.DiscardQuarantined(params[1])
+		if err != nil {
+			return "Error in discard " + err.Error()
+		}
+		return "Done"
+
 	case strings.HasPrefix(upcmd, "BEGIN"):
-		if !inTx {
-			DB.Begin()
-			inTx = true
+		if Tx == nil {
+			tx, err := DB.Begin()
+			if err != nil {
+				return "Error in begin " + err.Error()
+			}
+			Tx = tx
 		} else {
 			return "Just in a transaction"
 		}
@@ -192,18 +271,21 @@ func processCmd(cmd string) string {
 		return "BEGIN"
 
 	case strings.HasPrefix(upcmd, "COMMIT"):
-		if inTx {
-			DB.Commit()
-			inTx = false
+		if Tx != nil {
+			err := Tx.Commit()
+			Tx = nil
+			if err != nil {
+				return "Error in commit " + err.Error()
+			}
 		} else {
 			return "Not in a transaction"
 		}
 		return "COMMIT"
 
 	case strings.HasPrefix(upcmd, "ROLLBACK"):
-		if inTx {
-			DB.Rollback()
-			inTx = false
+		if Tx != nil {
+			Tx.Rollback()
+			Tx = nil
 		} else {
 			return "Not in a transaction"
 		}
@@ -211,11 +293,13 @@ func processCmd(cmd string) string {
 
 	case strings.HasPrefix(upcmd, "SELECT") || strings.HasPrefix(upcmd, "EXPLAIN") ||
 		strings.HasPrefix(upcmd, "PRAGMA"):
-		if !inTx {
-			DB.BeginForQuery()
-			defer DB.Commit()
+		tx, done, err := currentTx(true)
+		if err != nil {
+			return "Error in begin " + err.Error()
 		}
-		rows, cols, err := DB.Query(cmd, []interface{}{})
+		defer done()
+
+		rows, cols, err := tx.Query(cmd, []interface{}{})
 		if err != nil {
 			return "Error in query " + err.Error()
 		}
@@ -234,11 +318,13 @@ func processCmd(cmd string) string {
 	case strings.HasPrefix(upcmd, "UPDATE") || strings.HasPrefix(upcmd, "CREATE") ||
 		strings.HasPrefix(upcmd, "ALTER") || strings.HasPrefix(upcmd, "INSERT"):
 
-		if !inTx {
-			DB.Begin()
-			defer DB.Commit()
+		tx, done, err := currentTx(false)
+		if err != nil {
+			return "Error in begin " + err.Error()
 		}
-		err := DB.Exec(cmd, []interface{}{})
+		defer done()
+
+		err = tx.Exec(cmd, []interface{}{})
 		if err != nil {
 			return "Error in sql exec " + err.Error()
 		}
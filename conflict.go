@@ -0,0 +1,432 @@
+package syncdb
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+//ConflictAction is the choice of a ConflictResolver
+type ConflictAction int
+
+const (
+	//Reject fail the remote tx, nothing of it is written and it go to
+	//quarantine. It is the zero value, and the action without resolver
+	Reject ConflictAction = iota
+	//KeepLocal skip the remote statement, the local rows stay as they are
+	//and the other statements of the tx are applied
+	KeepLocal
+	//TakeRemote delete the local rows in conflict and apply the remote statement
+	TakeRemote
+	//Merge apply the statements of the Resolution instead of the remote one
+	Merge
+	//Defer don't apply the remote tx now, it is received again in the next sync
+	Defer
+)
+
+const (
+	versionTriggerPrefix = "__dbver_"
+)
+
+//Resolution is the choice of a ConflictResolver
+type Resolution struct {
+	Action ConflictAction
+	//Merge are the statements applied with the Merge action, only in this
+	//node: the remote tx is kept as it was received
+	Merge []SQLreg
+}
+
+//LocalRow is a local row in conflict with a remote statement
+type LocalRow struct {
+	//Values are in the order of Conflict.Cols
+	Values RowValues
+	//TxID, Origin, HLC and TxDatetime are of the last tx that wrote the row,
+	//empty when it is unknown
+	TxID, Origin, HLC, TxDatetime string
+}
+
+//Conflict is a statement of a remote tx failed by a constraint with the
+//local rows
+type Conflict struct {
+	//TxID, Origin, HLC and TxDatetime are of the remote tx
+	TxID, Origin, HLC, TxDatetime string
+	Statement                     SQLreg
+	Err                           error
+
+	//Table and Cols of the local rows in conflict with the statement
+	Table string
+	Cols  []string
+	Local []LocalRow
+
+	//where select the local rows
+	where  string
+	params []interface{}
+}
+
+//ConflictResolver choose what to do with a conflict applying a remote tx
+type ConflictResolver interface {
+	Resolve(c *Conflict) Resolution
+}
+
+//ResolverFunc is a function used as ConflictResolver
+type ResolverFunc func(c *Conflict) Resolution
+
+//Resolve call f
+func (f ResolverFunc) Resolve(c *Conflict) Resolution {
+	return f(c)
+}
+
+//LastWriterWins keep the rows of the last tx in the global order of txs,
+//by hybrid logical clock. Rows with unknown tx are older than all txs
+type LastWriterWins struct{}
+
+//Resolve take the remote statement when it is after all local rows
+func (LastWriterWins) Resolve(c *Conflict) Resolution {
+	remote := txOrderKey(c.HLC, c.TxDatetime, c.TxID)
+	for _, row := range c.Local {
+		if len(row.TxID) > 0 && txOrderKey(row.HLC, row.TxDatetime, row.TxID) > remote {
+			return Resolution{Action: KeepLocal}
+		}
+	}
+	return Resolution{Action: TakeRemote}
+}
+
+//OriginPriority keep the rows of the origin node first in the list, nodes
+//not listed have the lowest priority. Ties are resolved by LastWriterWins
+type OriginPriority []string
+
+func (p OriginPriority) rank(origin string) int {
+	for i, o := range p {
+		if o == origin {
+			return i
+		}
+	}
+	return len(p)
+}
+
+//Resolve take the remote statement when its origin has more priority than
+//the origin of all local rows
+func (p OriginPriority) Resolve(c *Conflict) Resolution {
+	remote := p.rank(c.Origin)
+	tie := false
+	for _, row := range c.Local {
+		rank := p.rank(row.Origin)
+		if rank < remote {
+			return Resolution{Action: KeepLocal}
+		}
+		if rank == remote {
+			tie = true
+		}
+	}
+
+	if tie {
+		return LastWriterWins{}.Resolve(c)
+	}
+	return Resolution{Action: TakeRemote}
+}
+
+//versionTriggerSQL return the triggers recording in __DBROWVER__ the last
+//tx writing each row of table, the current tx is the last in __DBTX__
+func versionTriggerSQL(table string) []string {
+	name := func(op string) string {
+		return quoteIdent(versionTriggerPrefix + table + "_" + op)
+	}
+	t := quoteIdent(table)
+	lt := quoteLiteral(table)
+	set := "INSERT OR REPLACE INTO __DBROWVER__(TBL, RID, TXID) SELECT " + lt +
+		", NEW.rowid, ID FROM __DBTX__ ORDER BY ROWID DESC LIMIT 1;"
+	del := "DELETE FROM __DBROWVER__ WHERE TBL = " + lt + " AND RID = OLD.rowid;"
+
+	return []string{
+		"CREATE TRIGGER " + name("i") + " AFTER INSERT ON " + t + " BEGIN " + set + " END",
+		"CREATE TRIGGER " + name("u") + " AFTER UPDATE ON " + t + " BEGIN " + del + " " + set + " END",
+		"CREATE TRIGGER " + name("d") + " AFTER DELETE ON " + t + " BEGIN " + del + " END",
+	}
+}
+
+//createVersionTriggers (re)create the row version triggers of all tables
+//with rowid, it must be in a transaction. Without resolver there are no
+//triggers, the rows are not versioned
+func (tx *Tx) createVersionTriggers() error {
+	err := tx.dropTriggers(versionTriggerPrefix)
+	if err != nil || tx.db.Resolver == nil {
+		return err
+	}
+
+	tables, err := tx.userTables()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		info, err := tx.tableInfo(table)
+		if err != nil {
+			return err
+		}
+		if !info.rowid {
+			continue
+		}
+		for _, sql := range versionTriggerSQL(table) {
+			err = tx.ExecWithoutLog(sql, []interface{}{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//configureVersions create the row version triggers, without resolver it
+//remove the versions of a previous open, they would be stale
+func (db *SyncDB) configureVersions() error {
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	return tx.configureVersions()
+}
+
+//configureVersions is configureVersions in the transaction
+func (tx *Tx) configureVersions() error {
+	if tx.db.Resolver == nil {
+		err := tx.ExecWithoutLog("DELETE FROM __DBROWVER__", []interface{}{})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.createVersionTriggers()
+}
+
+//isConflict report if err is a constraint failed by the local rows
+func isConflict(err error) bool {
+	if err == ErrRowNotFound {
+		return true
+	}
+	e, ok := err.(sqlite3.Error)
+	return ok && e.Code == sqlite3.ErrConstraint
+}
+
+//constraintCols return the table and columns of the constraint in the
+//message of err, like "UNIQUE constraint failed: foo.id, foo.name"
+func constraintCols(err error) (string, []string) {
+	msg := err.Error()
+	i := strings.Index(msg, "constraint failed: ")
+	if i < 0 {
+		return "", nil
+	}
+
+	table, cols := "", []string{}
+	for _, name := range strings.Split(msg[i+len("constraint failed: "):], ", ") {
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			return "", nil
+		}
+		table = name[:dot]
+		cols = append(cols, name[dot+1:])
+	}
+	return table, cols
+}
+
+//conflict return the conflict of the statement of the remote tx failed by
+//err, nil if err is not a conflict
+func (tx *Tx) conflict(remote txReg, reg SQLreg, err error) *Conflict {
+	if !isConflict(err) {
+		return nil
+	}
+
+	c := &Conflict{TxID: remote.ID, Origin: remote.Origin, HLC: remote.HLC, TxDatetime: remote.TxDatetime,
+		Statement: reg, Err: err}
+	errLocal := tx.localRows(c)
+	if errLocal != nil {
+		log.Println("ERROR reading local rows of conflict", remote.ID, errLocal)
+	}
+	return c
+}
+
+//localRows find the local rows in conflict with the statement. They are
+//known for row changes and for INSERT ... VALUES of one row
+func (tx *Tx) localRows(c *Conflict) error {
+	table, cols := constraintCols(c.Err)
+	if c.Statement.Row != nil {
+		table = c.Statement.Row.Table
+	}
+	if len(table) == 0 {
+		return nil
+	}
+
+	info, err := tx.tableInfo(table)
+	if err != nil {
+		return err
+	}
+	c.Table, c.Cols = table, info.cols
+
+	conds := []string{}
+	params := []interface{}{}
+	if row := c.Statement.Row; row != nil {
+		//an update of a row that not exists has no local rows
+		if c.Err == ErrRowNotFound || len(cols) == 0 {
+			return nil
+		}
+		for _, col := range cols {
+			for i, rcol := range row.Cols {
+				if rcol == col && i < len(row.New) {
+					params = append(params, row.New[i])
+					conds = append(conds, quoteIdent(col)+" IS ?"+strconv.Itoa(len(params)))
+				}
+			}
+		}
+	} else {
+		toks := tokenize(c.Statement.SQL)
+		stmt := parseInsert(toks)
+		if stmt == nil || len(stmt.tuples) != 1 {
+			return nil
+		}
+		maxParam := 0
+		for _, col := range cols {
+			pos := stmt.colIndex(col, info)
+			if pos < 0 || pos >= len(stmt.tuples[0]) {
+				return nil
+			}
+			expr, n := exprText(c.Statement.SQL, stmt.tuples[0][pos])
+			conds = append(conds, quoteIdent(col)+" IS ("+expr+")")
+			if n > maxParam {
+				maxParam = n
+			}
+		}
+		if maxParam > len(c.Statement.Params) {
+			return nil
+		}
+		params = c.Statement.Params[:maxParam]
+	}
+	if len(conds) != len(cols) {
+		return nil
+	}
+	c.where, c.params = strings.Join(conds, " AND "), params
+	return tx.selectLocalRows(c, info)
+}
+
+//selectLocalRows read the local rows selected by the conflict, with the
+//last tx writing them
+func (tx *Tx) selectLocalRows(c *Conflict, info tableInfo) error {
+	table := c.Table
+	sels := []string{}
+	for _, col := range info.cols {
+		sels = append(sels, quoteIdent(col), "typeof("+quoteIdent(col)+")")
+	}
+	if info.rowid {
+		sels = append(sels, "rowid")
+	}
+	rows, err := tx.tx.Query("SELECT "+strings.Join(sels, ", ")+" FROM "+quoteIdent(table)+
+		" WHERE "+c.where, c.params...)
+	if err != nil {
+		return err
+	}
+
+	rids := []interface{}{}
+	for rows.Next() {
+		vals := make([]interface{}, len(sels))
+		ptrs := make([]interface{}, len(sels))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		local := LocalRow{}
+		for i := range info.cols {
+			val := vals[2*i]
+			//the driver return text as []byte
+			if asString(vals[2*i+1]) == "text" {
+				val = asString(val)
+			}
+			local.Values = append(local.Values, val)
+		}
+		c.Local = append(c.Local, local)
+		if info.rowid {
+			rids = append(rids, vals[len(vals)-1])
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, rid := range rids {
+		res, _, err := tx.Query(`SELECT V.TXID, IFNULL(T.ORIGIN, ''), IFNULL(T.HLC, ''), IFNULL(T.DATETIME, '')
+			FROM __DBROWVER__ V LEFT JOIN __DBTX__ T ON T.ID = V.TXID WHERE V.TBL = ? AND V.RID = ?`,
+			[]interface{}{table, rid})
+		if err != nil {
+			return err
+		}
+		if len(res) == 1 {
+			c.Local[i].TxID, c.Local[i].Origin = *res[0][0].(*string), *res[0][1].(*string)
+			c.Local[i].HLC, c.Local[i].TxDatetime = *res[0][2].(*string), *res[0][3].(*string)
+		}
+	}
+
+	return nil
+}
+
+//resolve apply the choice of the resolver for the conflict, Reject
+//without resolver. The remote statement is logged whatever the choice, so
+//the tx sent to other nodes is the same received. It return true when the
+//tx is deferred, and the error of the conflict when it is rejected
+func (tx *Tx) resolve(c *Conflict) (bool, error) {
+	res := Resolution{Action: Reject}
+	if tx.db.Resolver != nil {
+		res = tx.db.Resolver.Resolve(c)
+	}
+
+	var err error
+	switch res.Action {
+	case Reject:
+		return false, c.Err
+
+	case Defer:
+		return true, nil
+
+	case TakeRemote:
+		if len(c.where) > 0 {
+			err = tx.ExecWithoutLog("DELETE FROM "+quoteIdent(c.Table)+" WHERE "+c.where, c.params)
+			if err != nil {
+				break
+			}
+		}
+
+		reg := c.Statement
+		if reg.Row != nil && c.Err == ErrRowNotFound {
+			row := *reg.Row
+			row.Op, row.Old = "INSERT", nil
+			reg.Row = &row
+		}
+		err = tx.applyReg(reg, false)
+
+	case Merge:
+		for _, reg := range res.Merge {
+			err = tx.applyReg(reg, false)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if tx.db.logMode == LogRows {
+		errClear := tx.clearChanges()
+		if err == nil {
+			err = errClear
+		}
+	}
+
+	errLog := tx.logReg(c.Statement)
+	if err == nil {
+		err = errLog
+	}
+	return false, err
+}
@@ -0,0 +1,190 @@
+package syncdb
+
+import (
+	"context"
+	"testing"
+)
+
+func newConflictNode(t *testing.T, resolver ConflictResolver) *SyncDB {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, Resolver: resolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-create", HLC{Wall: 100}, node2, 1,
+		`{"SQL": "create table foo(id integer not null primary key, name text)"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ := db.Begin()
+	err = tx.Exec("insert into foo values (1, ?)", []interface{}{"local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	return db
+}
+
+func TestConflictResolvers(t *testing.T) {
+	past, future := HLC{Wall: 200}, HLC{Wall: wallNow() + 3600000}
+	cases := []struct {
+		resolver ConflictResolver
+		hlc      HLC
+		names    string
+	}{
+		{ResolverFunc(func(c *Conflict) Resolution {
+			return Resolution{Action: KeepLocal}
+		}), future, "local"},
+		{LastWriterWins{}, past, "local"},
+		{LastWriterWins{}, future, "remote"},
+		{OriginPriority{node2}, past, "remote"},
+		{OriginPriority{"other", node2}, future, "remote"},
+		{OriginPriority{"other"}, future, "remote"},
+		{OriginPriority{"other"}, past, "local"},
+		{ResolverFunc(func(c *Conflict) Resolution {
+			return Resolution{Action: Merge, Merge: []SQLreg{{SQL: "update foo set name = name || '+remote'"}}}
+		}), past, "local+remote"},
+	}
+
+	for i, cs := range cases {
+		db := newConflictNode(t, cs.resolver)
+		defer db.Close(context.Background())
+
+		err := db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-insert", cs.hlc, node2, 2,
+			`{"SQL": "insert into foo values (1, 'remote')"}`)})
+		if err != nil {
+			t.Error(err)
+		}
+
+		if names := fooNames(t, db); names != cs.names {
+			t.Error("Wrong resolution", i, names, cs.names)
+		}
+
+		//the tx is kept as received
+		if n := dump(t, db, "select count(*) from __DBLOG__ where txid = 'tx-insert'"); n != `[["1"]]` {
+			t.Error("Remote statement not logged", i, n)
+		}
+	}
+}
+
+func TestConflictWithoutResolver(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text unique)", []interface{}{})
+	tx.Exec("insert into foo values (10, 'x')", []interface{}{})
+	tx.Commit()
+
+	//the clash of a statement fail the whole tx
+	err = db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-insert", HLC{Wall: 200}, node2, 1,
+		`{"SQL": "insert into foo values (1, 'x')"}`,
+		`{"SQL": "insert into foo values (2, 'y')"}`)})
+	applyErr, ok := err.(*TxApplyError)
+	if !ok || applyErr.TxID != "tx-insert" || applyErr.Statement.SQL != "insert into foo values (1, 'x')" {
+		t.Fatal("Expected TxApplyError", err)
+	}
+	if names := fooNames(t, db); names != "x" {
+		t.Error("Partial tx applied", names)
+	}
+	quarantined, err := db.QuarantinedTxs()
+	if err != nil || len(quarantined) != 1 || quarantined[0].ID != "tx-insert" {
+		t.Error("Rejected tx not quarantined", quarantined, err)
+	}
+}
+
+func TestConflictDetails(t *testing.T) {
+	var conflict *Conflict
+	db := newConflictNode(t, ResolverFunc(func(c *Conflict) Resolution {
+		conflict = c
+		return Resolution{Action: Defer}
+	}))
+	defer db.Close(context.Background())
+
+	tx, _ := db.BeginForQuery()
+	id, _ := tx.Get("id")
+	tx.Commit()
+
+	err := db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-insert", HLC{Wall: 200}, node2, 2,
+		`{"SQL": "insert into foo(name, id) values ('remote', ?)", "Params": [1]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conflict == nil {
+		t.Fatal("Conflict not resolved")
+	}
+	if conflict.TxID != "tx-insert" || conflict.Origin != node2 || conflict.Table != "foo" ||
+		len(conflict.Cols) != 2 || len(conflict.Local) != 1 {
+		t.Fatal("Wrong conflict", conflict)
+	}
+	local := conflict.Local[0]
+	if local.Values[0] != int64(1) || local.Values[1] != "local" || local.Origin != id || len(local.HLC) == 0 {
+		t.Error("Wrong local row", local)
+	}
+
+	//deferred txs are not applied
+	if n := dump(t, db, "select count(*) from __DBTX__ where id = 'tx-insert'"); n != `[["0"]]` {
+		t.Error("Deferred tx applied", n)
+	}
+	if names := fooNames(t, db); names != "local" {
+		t.Error("Wrong names", names)
+	}
+}
+
+func TestConflictRows(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, LogMode: LogRows,
+		Resolver: LastWriterWins{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, 'local')", []interface{}{})
+	tx.Commit()
+
+	err = db.syncRegister(context.Background(), "", []txReg{
+		remoteTx("tx-insert", HLC{Wall: wallNow() + 3600000}, node2, 1,
+			`{"Row": {"Table": "foo", "Op": "INSERT", "Cols": ["id", "name"], "Key": ["id"],
+			"New": [1, "remote"]}}`),
+		remoteTx("tx-update", HLC{Wall: wallNow() + 3600001}, node2, 2,
+			`{"Row": {"Table": "foo", "Op": "UPDATE", "Cols": ["id", "name"], "Key": ["id"],
+			"Old": [2, "x"], "New": [2, "updated"]}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := fooNames(t, db); names != "remote,updated" {
+		t.Error("Wrong names", names)
+	}
+}
+
+func TestRowVersionsOnlyWithResolver(t *testing.T) {
+	for _, resolver := range []ConflictResolver{nil, LastWriterWins{}} {
+		db, err := NewWithOptions(":memory:", Options{DisableServer: true, Resolver: resolver})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx, _ := db.Begin()
+		tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+		tx.Exec("insert into foo values (1, 'x')", []interface{}{})
+		tx.Commit()
+
+		triggers := dump(t, db, "select count(*) from sqlite_master where type = 'trigger' and name like '__dbver_%'")
+		versions := dump(t, db, "select count(*) from __DBROWVER__")
+		if resolver == nil && (triggers != `[["0"]]` || versions != `[["0"]]`) {
+			t.Error("Rows versioned without resolver", triggers, versions)
+		}
+		if resolver != nil && (triggers != `[["3"]]` || versions != `[["1"]]`) {
+			t.Error("Rows not versioned with resolver", triggers, versions)
+		}
+		db.Close(context.Background())
+	}
+}
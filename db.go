@@ -7,48 +7,130 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
-	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/satori/go.uuid"
 )
 
 //ISyncDB inteface to synchronized DB
 type ISyncDB interface {
-	Begin() error
+	Begin() (*Tx, error)
+	BeginCtx(ctx context.Context) (*Tx, error)
+	BeginForQuery() (*Tx, error)
+	BeginForQueryCtx(ctx context.Context) (*Tx, error)
+}
+
+//ITx inteface to a transaction of the synchronized DB
+type ITx interface {
 	Commit() error
 	Rollback() error
 	Exec(sql string, params []interface{}) error
+	ExecContext(ctx context.Context, sql string, params []interface{}) error
 	Query(sql string, params []interface{}) ([][]interface{}, []string, error)
+	QueryContext(ctx context.Context, sql string, params []interface{}) ([][]interface{}, []string, error)
 }
 
-//SQLreg record the sql smds
+//SQLreg record the sql smds, the row changed in LogRows mode or the
+//changeset in LogChangeset mode
 type SQLreg struct {
 	SQL    string
 	Params []interface{}
+	Row    *RowChange `json:",omitempty"`
+	//Changeset are the changes of the tx in LogChangeset mode
+	Changeset []byte `json:",omitempty"`
 }
 
 //SyncDB implementation
 type SyncDB struct {
-	sqlite    *sql.DB
-	mu        sync.Mutex
+	sqlite *sql.DB
+	//readers is the pool of read only connections of BeginForQuery, the
+	//same of sqlite for memory databases
+	readers *sql.DB
+	//writer is the lock that serialize the write txs
+	writer chan struct{}
+	port   int
+	name   string
+	Debug  bool
+
+	server        *http.Server
+	advertiseIP   string
+	advertisePort string
+
+	clock       hlcClock
+	totalOrder  bool
+	logMode     LogMode
+	determinism DeterminismPolicy
+
+	closeMu  sync.Mutex
+	closed   bool
+	applying sync.WaitGroup
+
+	//committed signal the local commits to the auto sync, autoStop stop it
+	//and autoDone is closed when it end. They are nil while not running
+	committed chan struct{}
+	autoStop  chan struct{}
+	autoDone  chan struct{}
+
+	//stats is the health of the syncs with each peer
+	stats   syncStats
+	metrics syncMetrics
+
+	//subs are the subscriptions to the committed txs
+	subsMu sync.Mutex
+	subs   map[*subscription]bool
+
+	//Discoverer find the nodes to sync, nil means URLDiscoverService
+	Discoverer Discoverer
+
+	//Resolver choose what to do when a statement of a remote tx fail by
+	//a constraint with the local rows, nil means Reject. The txs of the
+	//local rows are known only when it is set by Options.Resolver
+	Resolver ConflictResolver
+}
+
+//Tx is a transaction of the SyncDB, returned by Begin or BeginForQuery.
+//It must end with Commit or Rollback
+type Tx struct {
+	db        *SyncDB
 	tx        *sql.Tx
 	idtx      string
 	seq       int
-	port      int
 	queryOnly bool
-	name      string
-	Debug     bool
+	remote    bool
+	//locked is true while the write tx hold the writer slot (SyncDB.writer)
+	locked bool
+	//conn is the connection of the write txs, nil in read txs
+	conn *sql.Conn
+	//session record the changes of a local tx in LogChangeset mode
+	session *changeSession
+	//logged are the entries logged by the tx, applied the entries of a
+	//remote tx applied, and tables the tables changed by the write tx,
+	//recorded by the update hook, for the change feed
+	logged  []SQLreg
+	applied []SQLreg
+	tables  []string
+	//hook is the driver connection of the write tx
+	hook *sqlite3.SQLiteConn
 }
 
 var (
 	//ErrDBInQueryOnlyMode is an error for this condition
 	ErrDBInQueryOnlyMode = errors.New("DB in Query only mode")
+
+	//ErrTxDone is returned when the tx was already committed or rolled back
+	ErrTxDone = errors.New("Transaction already done")
+
+	//ErrDBClosed is returned when the DB is used after Close
+	ErrDBClosed = errors.New("DB closed")
+
+	//ErrInvalidLogMode is returned by NewWithOptions for an unknown LogMode
+	ErrInvalidLogMode = errors.New("Invalid log mode")
 )
 
 type contextKeyDB int
@@ -57,13 +139,67 @@ const (
 	keyDB contextKeyDB = iota
 )
 
+//Options configure a SyncDB
+type Options struct {
+	//ListenAddr is the address of the embedded sync server, like ":12345".
+	//Empty means a free port choose by the system
+	ListenAddr string
+	//AdvertiseAddr is the "host" or "host:port" announced to discovery,
+	//instead of local ips and listen port
+	AdvertiseAddr string
+	//DisableServer don't start the embedded sync server, the node only
+	//sync with the nodes it contact
+	DisableServer bool
+	//TotalOrder keep the database equal to the replay of all txs in the
+	//global order. A received tx older than the applied ones rebuild the
+	//database, so all nodes converge to the same contents
+	TotalOrder bool
+	//LogMode is how txs are recorded and shipped, LogSQL by default
+	LogMode LogMode
+	//Determinism is what Exec do with sqls that would have other results
+	//in the other nodes, like datetime('now'), random() or the rowid
+	//allocated by an insert. PolicyLenient by default. Only for LogSQL
+	Determinism DeterminismPolicy
+	//Resolver is the SyncDB.Resolver. With it the last tx writing each row
+	//is recorded, for the LocalRow of conflicts
+	Resolver ConflictResolver
+}
+
 //New create a new instance of SyncDB
 func New(arq string) (*SyncDB, error) {
-	db, err := sql.Open("sqlite3", arq)
+	return NewWithOptions(arq, Options{})
+}
+
+//NewWithOptions create a new instance of SyncDB configured by opts
+func NewWithOptions(arq string, opts Options) (*SyncDB, error) {
+	if opts.LogMode != LogSQL && opts.LogMode != LogRows && opts.LogMode != LogChangeset {
+		return nil, ErrInvalidLogMode
+	}
+	if opts.LogMode == LogChangeset && !changesetSupported {
+		return nil, ErrChangesetNotSupported
+	}
+
+	//in WAL mode the readers don't block the writer, and it don't block
+	//them. The driver set the journal mode of each connection
+	dsn := arq
+	if !isMemory(arq) {
+		dsn = withParam(arq, "_journal_mode=WAL")
+	}
+	//a REPLACE fire the delete triggers of the rows it remove only with
+	//recursive triggers, they must be captured in LogRows mode
+	if opts.LogMode == LogRows {
+		dsn = withParam(dsn, "_recursive_triggers=1")
+	}
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	//each connection to a memory database is other database
+	if isMemory(arq) {
+		db.SetMaxOpenConns(1)
+	}
+
 	_, err = db.Exec("PRAGMA INTEGRITY_CHECK")
 	if err != nil {
 		return nil, err
@@ -112,30 +248,339 @@ func New(arq string) (*SyncDB, error) {
 		return nil, err
 	}
 
-	DB := &SyncDB{sqlite: db}
+	//Origin node and its sequence of each tx, for incremental sync
+	err = addColumn(db, "__DBTX__", "ORIGIN", "TEXT")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "__DBTX__", "OSEQ", "INTEGER")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("create unique index if not exists origin_dbtx_idx on __DBTX__(ORIGIN, OSEQ)")
+	if err != nil {
+		return nil, err
+	}
+
+	//Hybrid logical clock of each tx, for a total order between nodes
+	err = addColumn(db, "__DBTX__", "HLC", "TEXT")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("create index if not exists hlc_dbtx_idx on __DBTX__(HLC)")
+	if err != nil {
+		return nil, err
+	}
+
+	//Rows changed by the current statement, filled by triggers in LogRows mode
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBCHG__ (ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		TBL TEXT NOT NULL,
+		OP TEXT NOT NULL,
+		OLDRID INTEGER,
+		NEWRID INTEGER)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBCHGVAL__ (CHG INTEGER NOT NULL,
+		IMG TEXT NOT NULL,
+		COL TEXT NOT NULL,
+		TYP TEXT NOT NULL,
+		VAL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	//Last tx writing each row, for conflict resolution
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBROWVER__ (TBL TEXT NOT NULL,
+		RID INTEGER NOT NULL,
+		TXID TEXT NOT NULL,
+		PRIMARY KEY (TBL, RID))`)
+	if err != nil {
+		return nil, err
+	}
+
+	//Remote txs failed to apply
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBQUARANTINE__ (ID TEXT NOT NULL PRIMARY KEY,
+		TX TEXT NOT NULL,
+		STATEMENT TEXT NOT NULL,
+		ERROR TEXT NOT NULL,
+		PEER TEXT NOT NULL,
+		ATTEMPTS INTEGER NOT NULL,
+		FIRSTSEEN TEXT NOT NULL,
+		LASTSEEN TEXT NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	//Checkpoints, the marks of the pruned txs and the acknowledgement of peers
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBCHECKPOINT__ (ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		DATETIME TEXT NOT NULL,
+		VECTOR TEXT NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBPRUNED__ (ORIGIN TEXT NOT NULL PRIMARY KEY,
+		OSEQ INTEGER NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	//the ids of the pruned txs, older nodes send them again without origin
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBPRUNEDTX__ (ID TEXT NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS __DBPEER__ (ID TEXT NOT NULL PRIMARY KEY,
+		ADDR TEXT NOT NULL,
+		VECTOR TEXT NOT NULL,
+		LASTSEEN TEXT NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "__DBPEER__", "LEGACY", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	readers := db
+	if !isMemory(arq) {
+		readers, err = sql.Open(driverName, withParam(dsn, "_query_only=1"))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	DB := &SyncDB{sqlite: db, readers: readers, totalOrder: opts.TotalOrder, logMode: opts.LogMode,
+		determinism: opts.Determinism, writer: make(chan struct{}, 1), committed: make(chan struct{}, 1),
+		Resolver: opts.Resolver}
 	DB.initSettings()
 
+	err = DB.configureCapture()
+	if err != nil {
+		DB.closeConns()
+		return nil, err
+	}
+
+	err = DB.configureVersions()
+	if err != nil {
+		DB.closeConns()
+		return nil, err
+	}
+
+	err = DB.loadClock()
+	if err != nil {
+		DB.closeConns()
+		return nil, err
+	}
+
+	err = DB.configureServer(opts)
+	if err != nil {
+		DB.closeConns()
+		return nil, err
+	}
+
+	return DB, nil
+}
+
+//isMemory report if arq is a memory database
+func isMemory(arq string) bool {
+	return arq == ":memory:" || strings.HasPrefix(arq, "file::memory:") || strings.Contains(arq, "mode=memory")
+}
+
+//withParam add the driver param to the dsn
+func withParam(dsn, param string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + param
+	}
+	return dsn + "?" + param
+}
+
+//addColumn add the column to table when it not exists, for databases
+//created by older versions
+func addColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt interface{}
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if found {
+		return nil
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+//configureServer start the embedded sync server and set the address
+//announced to discovery
+func (db *SyncDB) configureServer(opts Options) error {
+	if len(opts.AdvertiseAddr) > 0 {
+		host, port, err := net.SplitHostPort(opts.AdvertiseAddr)
+		if err != nil {
+			host, port = opts.AdvertiseAddr, ""
+		}
+		db.advertiseIP = host
+		db.advertisePort = port
+	}
+
+	if opts.DisableServer {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", opts.ListenAddr)
+	if err != nil {
+		return err
+	}
+	db.port = ln.Addr().(*net.TCPAddr).Port
+
+	serverMux := http.NewServeMux()
+	serverMux.HandleFunc("/txs", handleGetAllUUIDs)
+	serverMux.HandleFunc("/diffs", handleDiffs)
+	serverMux.HandleFunc("/vector", handleVector)
+	serverMux.HandleFunc("/buckets", handleBuckets)
+	serverMux.HandleFunc("/snapshot", handleSnapshot)
+	serverMux.HandleFunc("/status", handleStatus)
+	serverMux.HandleFunc("/metrics", handleMetrics)
+	contextedMux := func() http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), keyDB, db)
+			serverMux.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}()
+	db.server = &http.Server{Handler: contextedMux}
+
 	go func() {
-		serverMux := http.NewServeMux()
-		serverMux.HandleFunc("/txs", handleGetAllUUIDs)
-		serverMux.HandleFunc("/diffs", handleDiffs)
-		contextedMux := func() http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				ctx := context.WithValue(r.Context(), keyDB, DB)
-				serverMux.ServeHTTP(w, r.WithContext(ctx))
-			})
-		}()
-		for {
-			DB.mu.Lock()
-			DB.port = rand.Int()%10000 + 10000
-			DB.mu.Unlock()
-
-			log.Println(http.ListenAndServe(":"+strconv.Itoa(DB.port), contextedMux))
-			time.Sleep(1 * time.Second)
+		err := db.server.Serve(ln)
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	return nil
+}
+
+//advertise return the ips and port announced to discovery
+func (db *SyncDB) advertise() ([]string, string, error) {
+	port := db.advertisePort
+	if len(port) == 0 {
+		port = strconv.Itoa(db.port)
+	}
+
+	if len(db.advertiseIP) > 0 {
+		return []string{db.advertiseIP}, port, nil
+	}
+
+	ips, err := getMyIPs()
+	if err != nil {
+		return nil, "", err
+	}
+	return ips, port, nil
+}
+
+//Close stop the auto sync and the embedded sync server, wait them and the
+//remote txs being applied and close the database. When ctx expire before, the server and the
+//database are closed anyway, the applies in progress fail, and ctx.Err()
+//is returned
+func (db *SyncDB) Close(ctx context.Context) error {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return ErrDBClosed
+	}
+	db.closed = true
+	autoStop, autoDone := db.autoStop, db.autoDone
+	db.closeMu.Unlock()
+	db.unsubscribeAll()
+
+	var err error
+	if autoStop != nil {
+		close(autoStop)
+		select {
+		case <-autoDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if db.server != nil {
+		errShutdown := db.server.Shutdown(ctx)
+		if errShutdown != nil {
+			log.Println(errShutdown)
+			db.server.Close()
+			err = errShutdown
 		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		db.applying.Wait()
+		close(done)
 	}()
 
-	return DB, err
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	errClose := db.closeConns()
+	if err != nil {
+		return err
+	}
+	return errClose
+}
+
+//closeConns close the connections to the database
+func (db *SyncDB) closeConns() error {
+	var err error
+	if db.readers != nil && db.readers != db.sqlite {
+		err = db.readers.Close()
+	}
+	errClose := db.sqlite.Close()
+	if err != nil {
+		return err
+	}
+	return errClose
+}
+
+//startApply register a remote apply in progress, it fail if the DB is closed
+func (db *SyncDB) startApply() error {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+
+	if db.closed {
+		return ErrDBClosed
+	}
+	db.applying.Add(1)
+	return nil
 }
 
 func strace() string {
@@ -146,79 +591,198 @@ func strace() string {
 	return fmt.Sprintf("%s:%d %s\n", file, line, f.Name())
 }
 
-//Begin init transaction
-func (db *SyncDB) Begin() error {
+//Begin init a transaction that write. Write txs are serialized, the
+//next Begin wait the Commit or Rollback of the current one
+func (db *SyncDB) Begin() (*Tx, error) {
+	return db.BeginCtx(context.Background())
+}
+
+//BeginCtx is Begin with a context. It fail if ctx end while waiting the
+//other write txs, and the tx is rolled back if ctx end before Commit
+func (db *SyncDB) BeginCtx(ctx context.Context) (*Tx, error) {
 	if db.Debug {
 		log.Println("BEGIN", strace())
 	}
 	idtx, err := uuid.NewV4()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return db.beginWithIDAndDatetime(idtx.String(), "")
+	return db.beginWithIDAndDatetime(ctx, idtx.String(), "")
 }
 
-//beginWithIDAndDatetime init transaction
-func (db *SyncDB) beginWithIDAndDatetime(idtx, datetime string) error {
-	var err error
+//begin open a sql transaction, holding the writer lock when write. The
+//txs that only read use the read connections, and see the database as it
+//is at begin
+func (db *SyncDB) begin(ctx context.Context, write bool) (*Tx, error) {
+	if !write {
+		//in memory databases it wait the only connection, until ctx end
+		stx, err := db.readers.BeginTx(ctx, nil)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
 
-	db.mu.Lock()
+		//the first read fix the view of the tx
+		_, err = stx.Exec("SELECT COUNT(*) FROM sqlite_master")
+		if err != nil {
+			log.Println(err)
+			stx.Rollback()
+			return nil, err
+		}
+		return &Tx{db: db, tx: stx, seq: 1, queryOnly: true}, nil
+	}
 
-	db.tx, err = db.sqlite.Begin()
+	err := db.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.sqlite.Conn(ctx)
 	if err != nil {
 		log.Println(err)
-		return err
+		db.unlock()
+		return nil, err
 	}
+	tx, err := db.beginOn(ctx, conn)
+	if err != nil {
+		conn.Close()
+		db.unlock()
+		return nil, err
+	}
+	tx.locked = true
+	return tx, nil
+}
+
+//beginOn init a write tx in conn, the caller hold the writer slot and
+//close conn after the tx
+func (db *SyncDB) beginOn(ctx context.Context, conn *sql.Conn) (*Tx, error) {
+	stx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	tx := &Tx{db: db, tx: stx, seq: 1, queryOnly: true, conn: conn}
+	conn.Raw(func(dc interface{}) error {
+		tx.hook = dc.(*sqlite3.SQLiteConn)
+		return nil
+	})
+	hooksMu.Lock()
+	hooked[tx.hook] = tx
+	hooksMu.Unlock()
+	return tx, nil
+}
 
-	db.idtx = idtx
-	db.queryOnly = false
-	db.seq = 1
+//beginInternal init a write transaction for the internal tables, its
+//changes are not logged
+func (db *SyncDB) beginInternal() (*Tx, error) {
+	return db.begin(context.Background(), true)
+}
+
+//beginWithIDAndDatetime init transaction
+func (db *SyncDB) beginWithIDAndDatetime(ctx context.Context, idtx, datetime string) (*Tx, error) {
+	tx, err := db.begin(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.idtx = idtx
+	tx.queryOnly = false
 	if len(datetime) == 0 {
-		_, err = db.tx.Exec("INSERT INTO __DBTX__(id, datetime) VALUES (?, datetime('now'))", db.idtx)
+		_, err = tx.tx.Exec("INSERT INTO __DBTX__(id, datetime) VALUES (?, datetime('now'))", tx.idtx)
 	} else {
-		_, err = db.tx.Exec("INSERT INTO __DBTX__(id, datetime) VALUES (?, ?)", db.idtx, datetime)
+		_, err = tx.tx.Exec("INSERT INTO __DBTX__(id, datetime) VALUES (?, ?)", tx.idtx, datetime)
 	}
 	if err != nil {
 		log.Println(err)
-		return err
+		tx.abort()
+		return nil, err
 	}
 
-	return nil
+	return tx, nil
 }
 
-//BeginForQuery init transaction
-func (db *SyncDB) BeginForQuery() error {
-	if db.Debug {
-		log.Println("BEGINFORQUERY", strace())
+//beginRemote init transaction to apply the tx received from other node.
+//It return errTxExists, without a transaction open, if the tx was already applied
+func (db *SyncDB) beginRemote(ctx context.Context, remote txReg) (*Tx, error) {
+	tx, err := db.begin(ctx, true)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
+	//pruned txs were applied
+	res, _, err := tx.Query(`SELECT id FROM __DBTX__ WHERE ID = ?1
+		UNION ALL SELECT ID FROM __DBPRUNEDTX__ WHERE ID = ?1
+		UNION ALL SELECT ORIGIN FROM __DBPRUNED__ WHERE ORIGIN = ?2 AND OSEQ >= ?3`,
+		[]interface{}{remote.ID, remote.Origin, remote.OSeq})
+	if err == nil && len(res) > 0 {
+		err = errTxExists
+	}
+	if err != nil {
+		tx.abort()
+		return nil, err
+	}
 
-	db.mu.Lock()
+	tx.idtx = remote.ID
+	tx.queryOnly = false
+	tx.remote = true
 
-	db.tx, err = db.sqlite.Begin()
+	var origin, oseq, hlc interface{}
+	if len(remote.Origin) > 0 {
+		origin, oseq = remote.Origin, remote.OSeq
+	}
+	if len(remote.HLC) > 0 {
+		hlc = remote.HLC
+	}
+	_, err = tx.tx.Exec("INSERT INTO __DBTX__(id, datetime, origin, oseq, hlc) VALUES (?, ?, ?, ?, ?)",
+		tx.idtx, remote.TxDatetime, origin, oseq, hlc)
 	if err != nil {
 		log.Println(err)
-		return err
+		tx.abort()
+		return nil, err
 	}
 
-	db.idtx = ""
-	db.queryOnly = true
+	//the clock is always after the txs received
+	if h, err := ParseHLC(remote.HLC); err == nil {
+		db.clock.Update(h)
+		err = tx.saveClock()
+		if err != nil {
+			log.Println(err)
+			tx.abort()
+			return nil, err
+		}
+	}
 
-	return nil
+	return tx, nil
+}
+
+//BeginForQuery init a transaction that only read. Query txs run in
+//parallel with the other txs, but in memory databases it wait the open
+//write tx: its goroutine must query by the write tx
+func (db *SyncDB) BeginForQuery() (*Tx, error) {
+	return db.BeginForQueryCtx(context.Background())
+}
+
+//BeginForQueryCtx is BeginForQuery with a context, the tx is rolled back
+//if ctx end before Commit
+func (db *SyncDB) BeginForQueryCtx(ctx context.Context) (*Tx, error) {
+	if db.Debug {
+		log.Println("BEGINFORQUERY", strace())
+	}
+
+	return db.begin(ctx, false)
 }
 
 //gcLog remove __DBTX__ entry without __DBLOG__ entries
-func (db *SyncDB) gcLog() error {
-	uuid := db.idtx
-	res, _, err := db.Query("SELECT id FROM __DBLOG__ WHERE TXID = ?", []interface{}{uuid})
+func (tx *Tx) gcLog() error {
+	uuid := tx.idtx
+	res, _, err := tx.Query("SELECT id FROM __DBLOG__ WHERE TXID = ?", []interface{}{uuid})
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
 	if len(res) == 0 {
-		err = db.ExecWithoutLog("DELETE FROM __DBTX__ WHERE ID = ?", []interface{}{uuid})
+		err = tx.ExecWithoutLog("DELETE FROM __DBTX__ WHERE ID = ?", []interface{}{uuid})
 		if err != nil {
 			log.Println(err)
 			return err
@@ -227,58 +791,287 @@ func (db *SyncDB) gcLog() error {
 	return nil
 }
 
-//Commit confirm the current transaction
-func (db *SyncDB) Commit() error {
-	if db.Debug {
+//unlock end the session, return the connection and release the writer
+//lock, once
+func (tx *Tx) unlock() {
+	if tx.hook != nil {
+		hooksMu.Lock()
+		delete(hooked, tx.hook)
+		hooksMu.Unlock()
+		tx.hook = nil
+	}
+	if tx.locked {
+		tx.locked = false
+		tx.endSession()
+		tx.conn.Close()
+		tx.db.unlock()
+	}
+}
+
+//abort rollback the transaction being opened and release the lock
+func (tx *Tx) abort() {
+	tx.tx.Rollback()
+	tx.tx = nil
+	tx.unlock()
+}
+
+//Commit confirm the transaction. On error, nothing is written
+func (tx *Tx) Commit() error {
+	if tx.db.Debug {
 		log.Println("COMMIT", strace())
 	}
-	defer db.mu.Unlock()
-	err := db.gcLog()
-	if err != nil {
-		log.Println(err)
-		return err
+	if tx.tx == nil {
+		return ErrTxDone
 	}
+	defer tx.unlock()
 
-	err = db.tx.Commit()
+	var err error
+	if !tx.queryOnly {
+		err = tx.flushSession()
+		if err == nil {
+			err = tx.gcLog()
+		}
+		if err != nil {
+			log.Println(err)
+			tx.tx.Rollback()
+			tx.tx = nil
+			return err
+		}
+	}
+
+	//only txs with logged sqls are kept
+	local := !tx.queryOnly && !tx.remote && tx.seq > 1
+	var event *ChangeEvent
+	if local {
+		err = tx.stampTx()
+		if err != nil {
+			log.Println(err)
+			tx.tx.Rollback()
+			tx.tx = nil
+			return err
+		}
+
+		if tx.db.subscribed() {
+			ev, err := tx.localEvent()
+			if err != nil {
+				log.Println(err)
+			} else {
+				event = &ev
+			}
+		}
+	}
+
+	err = tx.tx.Commit()
+	tx.tx = nil
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	db.tx = nil
+
+	if !tx.queryOnly && !tx.remote {
+		tx.db.metrics.inc(&tx.db.metrics.commits)
+	}
+	if local {
+		select {
+		case tx.db.committed <- struct{}{}:
+		default:
+		}
+	}
+	if event != nil {
+		tx.db.publish(*event)
+	}
 	return nil
 }
 
-//Rollback cancel the current transaction
-func (db *SyncDB) Rollback() error {
-	if db.Debug {
+//Rollback cancel the transaction
+func (tx *Tx) Rollback() error {
+	if tx.db.Debug {
 		log.Println("ROLLBACK", strace())
 	}
-	defer db.mu.Unlock()
+	if tx.tx == nil {
+		return ErrTxDone
+	}
+	defer tx.unlock()
 
-	err := db.tx.Rollback()
+	if !tx.queryOnly && !tx.remote {
+		tx.db.metrics.inc(&tx.db.metrics.rollbacks)
+	}
+	err := tx.tx.Rollback()
+	tx.tx = nil
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	db.tx = nil
 	return nil
 }
 
 //Exec execute sql on db
-func (db *SyncDB) Exec(sql string, params []interface{}) error {
-	if db.queryOnly {
+func (tx *Tx) Exec(sql string, params []interface{}) error {
+	return tx.ExecContext(context.Background(), sql, params)
+}
+
+//ExecContext execute sql on db, the statement is interrupted if ctx end
+func (tx *Tx) ExecContext(ctx context.Context, sql string, params []interface{}) error {
+	if tx.tx == nil {
+		return ErrTxDone
+	}
+	if tx.queryOnly {
 		return ErrDBInQueryOnlyMode
 	}
+	if !tx.remote {
+		tx.db.metrics.inc(&tx.db.metrics.execs)
+	}
+
+	//the sqls received from other nodes are applied as they was logged
+	if tx.db.logMode == LogSQL && !tx.remote && !isSchemaSQL(sql) {
+		return tx.execDeterministic(ctx, sql, params)
+	}
+
+	//the session record the changes of local txs, the schema statements
+	//are logged between its changesets
+	changeset := tx.db.logMode == LogChangeset && !tx.remote
+	var err error
+	if changeset && isSchemaSQL(sql) {
+		err = tx.flushSession()
+	} else if changeset {
+		err = tx.startSession()
+	}
+	if err != nil {
+		return err
+	}
 
-	_, err := db.tx.Exec(sql, params...)
+	_, err = tx.tx.ExecContext(ctx, sql, params...)
 	if err != nil {
 		return err
 	}
 
-	reg := SQLreg{
+	if isSchemaSQL(sql) {
+		err = tx.createVersionTriggers()
+		if err != nil {
+			return err
+		}
+	}
+
+	if changeset {
+		if !isSchemaSQL(sql) {
+			return nil
+		}
+		err = tx.checkKeys()
+		if err != nil {
+			return err
+		}
+	}
+
+	if tx.db.logMode == LogRows {
+		if isSchemaSQL(sql) {
+			err = tx.createCaptureTriggers()
+			if err != nil {
+				return err
+			}
+		} else {
+			changes, err := tx.captureChanges()
+			if err != nil {
+				return err
+			}
+			for i := range changes {
+				err = tx.logReg(SQLreg{Row: &changes[i]})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return tx.logReg(SQLreg{
 		SQL:    sql,
-		Params: params}
+		Params: params})
+}
 
+//execDeterministic execute and log sql with the values got in this node
+//for its non-deterministic parts
+func (tx *Tx) execDeterministic(ctx context.Context, sql string, params []interface{}) error {
+	sql, params, rewrite, err := tx.deterministic(sql, params)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.tx.ExecContext(ctx, sql, params...)
+	if err != nil {
+		return err
+	}
+
+	if rewrite != nil {
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			sql, params = rewrite(id)
+		}
+	}
+
+	return tx.logReg(SQLreg{
+		SQL:    sql,
+		Params: params})
+}
+
+//ExecRow apply a row change and log it, like Exec
+func (tx *Tx) ExecRow(row RowChange) error {
+	if tx.tx == nil {
+		return ErrTxDone
+	}
+	if tx.queryOnly {
+		return ErrDBInQueryOnlyMode
+	}
+
+	//the row is in the changeset of local txs
+	if tx.db.logMode == LogChangeset && !tx.remote {
+		err := tx.startSession()
+		if err != nil {
+			return err
+		}
+		return tx.execRow(row)
+	}
+
+	err := tx.execRow(row)
+	if err != nil {
+		return err
+	}
+
+	return tx.logReg(SQLreg{Row: &row})
+}
+
+//applyReg execute the logged sql or row change. Logged entries are
+//recorded again in the current tx
+func (tx *Tx) applyReg(reg SQLreg, logged bool) error {
+	var err error
+	switch {
+	case reg.Changeset != nil:
+		//it record itself as applied, before its merges
+		return tx.applyChangeset(reg, logged)
+	case reg.Row != nil && logged:
+		err = tx.ExecRow(*reg.Row)
+	case reg.Row != nil:
+		err = tx.execRow(*reg.Row)
+	case logged:
+		err = tx.Exec(reg.SQL, reg.Params)
+	default:
+		err = tx.ExecWithoutLog(reg.SQL, reg.Params)
+	}
+
+	if err == nil && tx.remote {
+		tx.applied = append(tx.applied, reg)
+	}
+	return err
+}
+
+//logReg record the entry in __DBLOG__ for the current tx
+func (tx *Tx) logReg(reg SQLreg) error {
 	b, err := json.Marshal(reg)
 	if err != nil {
 		return err
@@ -288,22 +1081,31 @@ func (db *SyncDB) Exec(sql string, params []interface{}) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.tx.Exec("INSERT INTO __DBLOG__(id, txid, sql, seq, datetime) VALUES (?, ?, ?, ?, datetime('now'))",
+	_, err = tx.tx.Exec("INSERT INTO __DBLOG__(id, txid, sql, seq, datetime) VALUES (?, ?, ?, ?, datetime('now'))",
 		idlog.String(),
-		db.idtx,
+		tx.idtx,
 		string(b),
-		db.seq)
+		tx.seq)
 	if err != nil {
 		return err
 	}
 
-	db.seq++
+	tx.seq++
+	tx.logged = append(tx.logged, reg)
 	return nil
 }
 
-//ExecWithoutLog execute sql on db
-func (db *SyncDB) ExecWithoutLog(sql string, params []interface{}) error {
-	_, err := db.tx.Exec(sql, params...)
+//ExecWithoutLog execute sql on db, it is not sent to other nodes
+func (tx *Tx) ExecWithoutLog(sql string, params []interface{}) error {
+	if tx.tx == nil {
+		return ErrTxDone
+	}
+	//only the write txs have a connection of their own
+	if tx.conn == nil {
+		return ErrDBInQueryOnlyMode
+	}
+
+	_, err := tx.tx.Exec(sql, params...)
 	if err != nil {
 		return err
 	}
@@ -312,8 +1114,16 @@ func (db *SyncDB) ExecWithoutLog(sql string, params []interface{}) error {
 }
 
 //Query make a query on db return interfaces
-func (db *SyncDB) Query(sql string, params []interface{}) ([][]interface{}, []string, error) {
-	rows, err := db.tx.Query(sql, params...)
+func (tx *Tx) Query(sql string, params []interface{}) ([][]interface{}, []string, error) {
+	return tx.QueryContext(context.Background(), sql, params)
+}
+
+//QueryContext make a query on db, it is interrupted if ctx end
+func (tx *Tx) QueryContext(ctx context.Context, sql string, params []interface{}) ([][]interface{}, []string, error) {
+	if tx.tx == nil {
+		return nil, nil, ErrTxDone
+	}
+	rows, err := tx.tx.QueryContext(ctx, sql, params...)
 	if err != nil {
 		return nil, nil, err
 	}
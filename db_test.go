@@ -1,7 +1,11 @@
 package syncdb
 
 import (
+	"context"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestNewSyncDB(t *testing.T) {
@@ -9,23 +13,24 @@ func TestNewSyncDB(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer s.Close(context.Background())
 
-	err = s.Begin()
+	tx, err := s.Begin()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = s.Commit()
+	err = tx.Commit()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = s.Begin()
+	tx, err = s.Begin()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = s.Rollback()
+	err = tx.Rollback()
 	if err != nil {
 		t.Error(err)
 	}
@@ -38,33 +43,34 @@ func TestSyncDBCreateTable(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Close(context.Background())
 
-	err = db.Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Exec("create table foo(id integer not null primary key, name text);", []interface{}{})
+	err = tx.Exec("create table foo(id integer not null primary key, name text);", []interface{}{})
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Exec("insert into foo values (NULL, ?)", []interface{}{"teste"})
+	err = tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste"})
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Commit()
+	err = tx.Commit()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Begin()
+	tx, err = db.Begin()
 	if err != nil {
 		t.Error(err)
 	}
 
-	rows, cols, err := db.Query("select * from foo", []interface{}{})
+	rows, cols, err := tx.Query("select * from foo", []interface{}{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -77,7 +83,7 @@ func TestSyncDBCreateTable(t *testing.T) {
 		t.Error("Wrong number of rows")
 	}
 
-	err = db.Commit()
+	err = tx.Commit()
 	if err != nil {
 		t.Error(err)
 	}
@@ -90,17 +96,18 @@ func TestQuery(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Close(context.Background())
 
-	db.Begin()
-	defer db.Commit()
+	tx, _ := db.Begin()
+	defer tx.Commit()
 
-	db.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
-	db.Exec("insert into foo values (NULL, ?)", []interface{}{"teste1"})
-	db.Exec("insert into foo values (NULL, ?)", []interface{}{"teste2"})
-	db.Exec("insert into foo values (NULL, ?)", []interface{}{"teste3"})
-	db.Exec("insert into foo values (NULL, ?)", []interface{}{"teste4"})
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste1"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste2"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste3"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste4"})
 
-	rows, _, err := db.Query("select name from foo", []interface{}{})
+	rows, _, err := tx.Query("select name from foo", []interface{}{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -122,3 +129,320 @@ func TestQuery(t *testing.T) {
 		t.Error("Expected 'teste4' - value", rows[3][0].(*string))
 	}
 }
+
+func TestNewWithOptions(t *testing.T) {
+	db1, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0",
+		AdvertiseAddr: "10.1.1.1:9999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close(context.Background())
+
+	if db1.port == 0 {
+		t.Error("Port not set")
+	}
+
+	ips, port, err := db1.advertise()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(ips) != 1 || ips[0] != "10.1.1.1" || port != "9999" {
+		t.Error("Wrong advertise address", ips, port)
+	}
+
+	//the port is in use, bind must fail
+	_, err = NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:" + strconv.Itoa(db1.port)})
+	if err == nil {
+		t.Error("Expected bind error")
+	}
+
+	_, err = NewWithOptions(":memory:", Options{DisableServer: true, LogMode: LogMode(7)})
+	if err != ErrInvalidLogMode {
+		t.Error("Expected ErrInvalidLogMode", err)
+	}
+
+	db2, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close(context.Background())
+	if db2.server != nil || db2.port != 0 {
+		t.Error("Server not disabled")
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(db.port)
+
+	err = db.Close(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = getAllUUIDSFromNode(context.Background(), "127.0.0.1", strconv.Itoa(db.port), false)
+	if err == nil {
+		t.Error("Server still running after Close")
+	}
+
+	//the port must be free again
+	db, err = NewWithOptions(":memory:", Options{ListenAddr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.Close(context.Background())
+	if err != ErrDBClosed {
+		t.Error("Expected ErrDBClosed", err)
+	}
+
+	err = db.syncRegister(context.Background(), "", []txReg{})
+	if err != ErrDBClosed {
+		t.Error("Expected ErrDBClosed", err)
+	}
+}
+
+func TestCloseExpired(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an apply in progress is not waited after ctx expire
+	err = db.startApply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.applying.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.Close(ctx)
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled", err)
+	}
+
+	_, err = getAllUUIDSFromNode(context.Background(), "127.0.0.1", strconv.Itoa(db.port), false)
+	if err == nil {
+		t.Error("Server still running after Close")
+	}
+	if err = db.sqlite.Ping(); err == nil {
+		t.Error("Database still open after Close")
+	}
+	if err = db.Close(context.Background()); err != ErrDBClosed {
+		t.Error("Expected ErrDBClosed", err)
+	}
+}
+
+func TestMemoryReadDuringWrite(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	//the only connection is of the write tx, readers wait it
+	tx, _ := db.Begin()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = db.BeginForQueryCtx(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		reader, err := db.BeginForQuery()
+		if err == nil {
+			reader.Commit()
+		}
+		done <- err
+	}()
+	tx.Exec("create table foo(id integer not null primary key)", []interface{}{})
+	tx.Commit()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Reader not resumed after the commit")
+	}
+}
+
+func TestParallelTxs(t *testing.T) {
+	arq, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(arq)
+
+	db, err := NewWithOptions(arq, Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	//readers don't wait the write tx, and don't see its changes
+	tx, _ = db.Begin()
+	err = tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reader, err := db.BeginForQuery()
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			defer reader.Commit()
+
+			rows, _, err := reader.Query("select count(*) from foo", []interface{}{})
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			done <- *rows[0][0].(*string)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-done:
+			if n != "1" {
+				t.Error("Wrong rows read", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Reader blocked by the write tx")
+		}
+	}
+
+	//the next write tx wait the current one
+	written := make(chan error)
+	go func() {
+		tx, err := db.Begin()
+		if err == nil {
+			err = tx.Exec("insert into foo values (3, ?)", []interface{}{"teste3"})
+			tx.Commit()
+		}
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("Write txs not serialized")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+	if err = <-written; err != nil {
+		t.Error(err)
+	}
+	if n := dump(t, db, "select count(*) from foo"); n != `[["3"]]` {
+		t.Error("Wrong rows", n)
+	}
+
+	err = tx.Commit()
+	if err != ErrTxDone {
+		t.Error("Expected ErrTxDone", err)
+	}
+	err = tx.Exec("insert into foo values (4, ?)", []interface{}{"teste4"})
+	if err != ErrTxDone {
+		t.Error("Expected ErrTxDone", err)
+	}
+
+	reader, _ := db.BeginForQuery()
+	defer reader.Commit()
+	err = reader.Exec("insert into foo values (4, ?)", []interface{}{"teste4"})
+	if err != ErrDBInQueryOnlyMode {
+		t.Error("Expected ErrDBInQueryOnlyMode", err)
+	}
+	err = reader.ExecWithoutLog("delete from foo", []interface{}{})
+	if err != ErrDBInQueryOnlyMode {
+		t.Error("Expected ErrDBInQueryOnlyMode", err)
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	arq, err := tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(arq)
+
+	db, err := NewWithOptions(arq, Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	if mode := dump(t, db, "PRAGMA journal_mode"); mode != `[["wal"]]` {
+		t.Error("Wrong journal mode", mode)
+	}
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	reader, err := db.BeginForQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//local and remote txs are committed while the reader is open
+	done := make(chan error)
+	go func() {
+		tx, err := db.Begin()
+		if err == nil {
+			tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-remote", HLC{Wall: 100}, node2, 1,
+				`{"SQL": "insert into foo values (3, 'teste3')"}`)})
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Writes blocked by the reader")
+	}
+
+	//the reader keep the view of its begin
+	rows, _, err := reader.Query("select count(*) from foo", []interface{}{})
+	if err != nil || *rows[0][0].(*string) != "1" {
+		t.Error("Reader see changes after its begin", err)
+	}
+	reader.Commit()
+
+	if n := dump(t, db, "select count(*) from foo"); n != `[["3"]]` {
+		t.Error("Wrong rows", n)
+	}
+
+	_, _, err = reader.Query("select count(*) from foo", []interface{}{})
+	if err != ErrTxDone {
+		t.Error("Expected ErrTxDone", err)
+	}
+}
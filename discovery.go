@@ -0,0 +1,132 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+//Discoverer find the nodes of a company that this node can sync with
+type Discoverer interface {
+	Discover(ips []string, company, port, id string) (map[string]NodeInfo, error)
+}
+
+//ContextDiscoverer is a Discoverer that can be canceled, the sync call
+//DiscoverContext with its ctx when the Discoverer has it
+type ContextDiscoverer interface {
+	Discoverer
+	DiscoverContext(ctx context.Context, ips []string, company, port, id string) (map[string]NodeInfo, error)
+}
+
+//NodeInfo is info about node
+type NodeInfo struct {
+	IP   string
+	Port string
+	Rum  string
+}
+
+//HTTPDiscoverer get the nodes from a discovery service over http
+type HTTPDiscoverer struct {
+	URL string
+}
+
+//Discover register this node on service and return the nodes of company
+func (d *HTTPDiscoverer) Discover(ips []string, company, port, id string) (map[string]NodeInfo, error) {
+	return d.DiscoverContext(context.Background(), ips, company, port, id)
+}
+
+//DiscoverContext is Discover, the request is canceled when ctx end
+func (d *HTTPDiscoverer) DiscoverContext(ctx context.Context, ips []string, company, port,
+	id string) (map[string]NodeInfo, error) {
+	return discoverNodes(ctx, d.URL, ips, company, port, id)
+}
+
+//StaticDiscoverer is a fixed list of nodes, indexed by node id
+type StaticDiscoverer map[string]NodeInfo
+
+//NewStaticDiscoverer create a StaticDiscoverer from "ip:port" addresses
+func NewStaticDiscoverer(addrs ...string) (StaticDiscoverer, error) {
+	nodes := StaticDiscoverer{}
+	for _, addr := range addrs {
+		ip, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		nodes[addr] = NodeInfo{IP: ip, Port: port}
+	}
+	return nodes, nil
+}
+
+//Discover return the nodes of the list
+func (d StaticDiscoverer) Discover(ips []string, company, port, id string) (map[string]NodeInfo, error) {
+	nodes := map[string]NodeInfo{}
+	for key, val := range d {
+		nodes[key] = val
+	}
+	return nodes, nil
+}
+
+//FileDiscoverer read the nodes from a json file, in the same format
+//returned by the discovery service
+type FileDiscoverer struct {
+	Path string
+}
+
+//Discover read the file and return the nodes on it
+func (d *FileDiscoverer) Discover(ips []string, company, port, id string) (map[string]NodeInfo, error) {
+	text, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := map[string]NodeInfo{}
+	err = json.Unmarshal(text, &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func discoverNodes(ctx context.Context, url string, ip []string, company, port,
+	id string) (map[string]NodeInfo, error) {
+	res, err := httpGet(ctx, url+"/?i="+strings.Join(ip, ",")+
+		"&c="+company+"&p="+port+"&id="+id)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := map[string]NodeInfo{}
+	err = json.Unmarshal(text, &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (db *SyncDB) discoverer() Discoverer {
+	if db.Discoverer != nil {
+		return db.Discoverer
+	}
+	return &HTTPDiscoverer{URL: URLDiscoverService}
+}
+
+//discover find the nodes with the discoverer, canceled when ctx end if it
+//is a ContextDiscoverer
+func (db *SyncDB) discover(ctx context.Context, ips []string, company, port,
+	id string) (map[string]NodeInfo, error) {
+	d := db.discoverer()
+	if cd, ok := d.(ContextDiscoverer); ok {
+		return cd.DiscoverContext(ctx, ips, company, port, id)
+	}
+	return d.Discover(ips, company, port, id)
+}
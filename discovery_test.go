@@ -0,0 +1,96 @@
+package syncdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticDiscoverer(t *testing.T) {
+	d, err := NewStaticDiscoverer("192.168.0.101:12345", "192.168.0.102:12346")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := d.Discover([]string{"192.168.0.101"}, idcompany, "12345", node1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Error("Wrong number of nodes")
+	}
+
+	if nodes["192.168.0.102:12346"].IP != "192.168.0.102" ||
+		nodes["192.168.0.102:12346"].Port != "12346" {
+		t.Error("Wrong node info", nodes["192.168.0.102:12346"])
+	}
+
+	_, err = NewStaticDiscoverer("192.168.0.101")
+	if err == nil {
+		t.Error("Expected error for address without port")
+	}
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nodes.json")
+	err = ioutil.WriteFile(path, []byte(`{"node1": {"IP": "192.168.0.101", "Port": "12345"},
+		"node2": {"IP": "192.168.0.102", "Port": "12346", "Rum": "(print 1)"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &FileDiscoverer{Path: path}
+	nodes, err := d.Discover(nil, idcompany, "12345", node1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Error("Wrong number of nodes")
+	}
+
+	if nodes[node2].Rum != "(print 1)" {
+		t.Error("Wrong rum script", nodes[node2].Rum)
+	}
+
+	d = &FileDiscoverer{Path: filepath.Join(dir, "missing.json")}
+	_, err = d.Discover(nil, idcompany, "12345", node1)
+	if err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestHTTPDiscovererContext(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	db.Discoverer = &HTTPDiscoverer{URL: hung.URL}
+
+	//a hung discovery service don't block the sync after the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = db.discover(ctx, nil, idcompany, "12345", node1)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Error("Discovery not canceled", err, time.Since(start))
+	}
+}
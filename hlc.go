@@ -0,0 +1,141 @@
+package syncdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrInvalidHLC is returned parsing a malformed hybrid logical clock
+	ErrInvalidHLC = errors.New("Invalid hybrid logical clock timestamp")
+)
+
+//HLC is a hybrid logical clock timestamp: the wall time in milliseconds
+//and a logical counter ordering the events with the same wall time
+type HLC struct {
+	Wall    int64
+	Logical uint32
+}
+
+//String format the timestamp in a form that sort as text
+func (h HLC) String() string {
+	return fmt.Sprintf("%015d-%010d", h.Wall, h.Logical)
+}
+
+//Before report if h happened before o
+func (h HLC) Before(o HLC) bool {
+	return h.Wall < o.Wall || (h.Wall == o.Wall && h.Logical < o.Logical)
+}
+
+//ParseHLC read a timestamp formatted by HLC.String
+func ParseHLC(s string) (HLC, error) {
+	h := HLC{}
+	n, err := fmt.Sscanf(s, "%d-%d", &h.Wall, &h.Logical)
+	if err != nil || n != 2 || h.String() != s {
+		return HLC{}, ErrInvalidHLC
+	}
+	return h, nil
+}
+
+//hlcClock generate timestamps always after the last timestamp seen
+type hlcClock struct {
+	mu   sync.Mutex
+	last HLC
+	now  func() int64
+}
+
+func wallNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (c *hlcClock) physical() int64 {
+	if c.now != nil {
+		return c.now()
+	}
+	return wallNow()
+}
+
+//Now return a timestamp for a local event
+func (c *hlcClock) Now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.physical()
+	if pt > c.last.Wall {
+		c.last = HLC{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+//Update advance the clock after receive the remote timestamp
+func (c *hlcClock) Update(remote HLC) HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.physical()
+	last := c.last
+	switch {
+	case pt > last.Wall && pt > remote.Wall:
+		c.last = HLC{Wall: pt}
+	case last.Wall == remote.Wall:
+		logical := last.Logical
+		if remote.Logical > logical {
+			logical = remote.Logical
+		}
+		c.last = HLC{Wall: last.Wall, Logical: logical + 1}
+	case last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last = HLC{Wall: remote.Wall, Logical: remote.Logical + 1}
+	}
+	return c.last
+}
+
+//Last return the last timestamp of the clock
+func (c *hlcClock) Last() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+//restore set the clock to a persisted timestamp, it never go back
+func (c *hlcClock) restore(h HLC) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.Before(h) {
+		c.last = h
+	}
+}
+
+//loadClock restore the clock persisted in settings
+func (db *SyncDB) loadClock() error {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	s, err := tx.Get("hlc")
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h, err := ParseHLC(s)
+	if err != nil {
+		return err
+	}
+	db.clock.restore(h)
+	return nil
+}
+
+//saveClock persist the clock in settings, it must be in a transaction
+func (tx *Tx) saveClock() error {
+	return tx.Set("hlc", tx.db.clock.Last().String())
+}
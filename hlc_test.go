@@ -0,0 +1,113 @@
+package syncdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHLCString(t *testing.T) {
+	h1 := HLC{Wall: 1542700000000, Logical: 2}
+	h2 := HLC{Wall: 1542700000000, Logical: 10}
+	h3 := HLC{Wall: 1542700000001}
+
+	if !(h1.String() < h2.String() && h2.String() < h3.String()) {
+		t.Error("Text order differ from clock order", h1, h2, h3)
+	}
+	if !h1.Before(h2) || !h2.Before(h3) || h3.Before(h1) {
+		t.Error("Wrong Before")
+	}
+
+	h, err := ParseHLC(h2.String())
+	if err != nil || h != h2 {
+		t.Error("Wrong parse", h, err)
+	}
+
+	_, err = ParseHLC("2018-11-20 10:00:00")
+	if err == nil {
+		t.Error("Expected error parsing datetime")
+	}
+}
+
+func TestHLCClock(t *testing.T) {
+	pt := int64(1000)
+	c := hlcClock{now: func() int64 { return pt }}
+
+	h1 := c.Now()
+	h2 := c.Now()
+	if h1 != (HLC{Wall: 1000}) || h2 != (HLC{Wall: 1000, Logical: 1}) {
+		t.Error("Wrong local timestamps", h1, h2)
+	}
+
+	//remote clock ahead
+	h3 := c.Update(HLC{Wall: 5000, Logical: 7})
+	if h3 != (HLC{Wall: 5000, Logical: 8}) {
+		t.Error("Wrong timestamp after receive", h3)
+	}
+
+	//physical clock behind, the clock don't go back
+	h4 := c.Now()
+	if !h3.Before(h4) {
+		t.Error("Clock went back", h3, h4)
+	}
+
+	//remote clock behind
+	h5 := c.Update(HLC{Wall: 10})
+	if !h4.Before(h5) {
+		t.Error("Clock went back", h4, h5)
+	}
+
+	pt = 9000
+	h6 := c.Now()
+	if h6 != (HLC{Wall: 9000}) {
+		t.Error("Wrong timestamp after physical advance", h6)
+	}
+}
+
+func TestHLCPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hlc.db")
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future := HLC{Wall: wallNow() + 3600*1000, Logical: 3}
+	err = db.syncRegister(context.Background(), "", []txReg{{ID: "tx-future", TxDatetime: "2018-11-20 10:00:00",
+		Origin: node2, OSeq: 1, HLC: future.String(),
+		SQLs: []logReg{{SQL: `{"SQL": "create table foo(id integer not null primary key, name text)"}`}}}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	tx, _ := db.Begin()
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	uuids, _ := db.getAllUUIDSLocal(false)
+	if len(uuids) != 2 || uuids[0] != "tx-future" {
+		t.Error("Local tx ordered before the received one", uuids)
+	}
+	local, _ := db.uuid2txReg(uuids[1])
+	if local.HLC <= future.String() {
+		t.Error("Local tx before received tx", local.HLC, future)
+	}
+	db.Close(context.Background())
+
+	db, err = New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	if db.clock.Last().String() < local.HLC {
+		t.Error("Clock not restored", db.clock.Last(), local.HLC)
+	}
+}
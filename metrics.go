@@ -0,0 +1,196 @@
+package syncdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//syncBuckets are the upper bounds, in seconds, of the sync duration histogram
+var syncBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//histogram count observations by bucket, not cumulative
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(syncBuckets))
+	}
+	for i, bound := range syncBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+//syncMetrics are the numbers served by /metrics, since the start
+type syncMetrics struct {
+	mu sync.Mutex
+
+	execs     int64
+	commits   int64
+	rollbacks int64
+	applied   int64
+	failed    int64
+	requests  map[string]int64
+
+	lockWait      time.Duration
+	lockWaitTotal time.Duration
+
+	syncs map[string]*histogram
+}
+
+//inc add one to the counter c of m
+func (m *syncMetrics) inc(c *int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	*c++
+}
+
+//request count a request served by the handler
+func (m *syncMetrics) request(handler string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests == nil {
+		m.requests = map[string]int64{}
+	}
+	m.requests[handler]++
+}
+
+//lockWaited record the time waited for the writer lock
+func (m *syncMetrics) lockWaited(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lockWait = d
+	m.lockWaitTotal += d
+}
+
+//synced record the duration of a sync with the peer
+func (m *syncMetrics) synced(peer string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.syncs == nil {
+		m.syncs = map[string]*histogram{}
+	}
+	h, ok := m.syncs[peer]
+	if !ok {
+		h = &histogram{}
+		m.syncs[peer] = h
+	}
+	h.observe(d.Seconds())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//write the metrics in the Prometheus text format, with the number of log
+//entries
+func (m *syncMetrics) write(w io.Writer, logEntries int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"syncdb_exec_total", "Local statements executed.", m.execs},
+		{"syncdb_commit_total", "Local transactions committed.", m.commits},
+		{"syncdb_rollback_total", "Local transactions rolled back.", m.rollbacks},
+		{"syncdb_remote_txs_applied_total", "Remote transactions applied.", m.applied},
+		{"syncdb_remote_txs_failed_total", "Remote transactions failed to apply.", m.failed},
+	} {
+		writeMetric(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+
+	writeMetric(w, "syncdb_requests_total", "counter", "Sync requests served, by handler.")
+	for _, handler := range []string{"/txs", "/diffs"} {
+		fmt.Fprintf(w, "syncdb_requests_total{handler=\"%s\"} %d\n", handler, m.requests[handler])
+	}
+
+	writeMetric(w, "syncdb_sync_duration_seconds", "histogram", "Duration of the syncs with each peer.")
+	peers := []string{}
+	for peer := range m.syncs {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		h, label := m.syncs[peer], labelEscaper.Replace(peer)
+		var cumulative int64
+		for i, bound := range syncBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "syncdb_sync_duration_seconds_bucket{peer=\"%s\",le=\"%g\"} %d\n", label, bound, cumulative)
+		}
+		fmt.Fprintf(w, "syncdb_sync_duration_seconds_bucket{peer=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "syncdb_sync_duration_seconds_sum{peer=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(w, "syncdb_sync_duration_seconds_count{peer=\"%s\"} %d\n", label, h.count)
+	}
+
+	writeMetric(w, "syncdb_log_entries", "gauge", "Rows in the tx log.")
+	fmt.Fprintf(w, "syncdb_log_entries %d\n", logEntries)
+	writeMetric(w, "syncdb_lock_wait_seconds", "gauge",
+		"Time waited for the writer slot by the last write transaction.")
+	fmt.Fprintf(w, "syncdb_lock_wait_seconds %g\n", m.lockWait.Seconds())
+	writeMetric(w, "syncdb_lock_wait_seconds_total", "counter",
+		"Time waited for the writer slot by the write transactions.")
+	fmt.Fprintf(w, "syncdb_lock_wait_seconds_total %g\n", m.lockWaitTotal.Seconds())
+}
+
+//lock take the writer lock, recording the time waited. It fail if ctx
+//end before
+func (db *SyncDB) lock(ctx context.Context) error {
+	start := time.Now()
+	select {
+	case db.writer <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	db.metrics.lockWaited(time.Since(start))
+	return nil
+}
+
+//unlock release the writer lock
+func (db *SyncDB) unlock() {
+	<-db.writer
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value(keyDB).(*SyncDB)
+
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logEntries, err := tx.count("SELECT COUNT(*) FROM __DBLOG__")
+	tx.Commit()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	db.metrics.write(w, logEntries)
+}
@@ -0,0 +1,75 @@
+package syncdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Rollback()
+
+	err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(db *SyncDB) string {
+		res, err := http.Get("http://127.0.0.1:" + strconv.Itoa(db.port) + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Header.Get("Content-Type") != "text/plain; version=0.0.4" {
+			t.Error("Wrong content type", res.Header.Get("Content-Type"))
+		}
+		return string(b)
+	}
+
+	//the commits include the settings of newTestNode
+	m1 := get(db1)
+	peer := `peer="127.0.0.1:` + strconv.Itoa(db2.port) + `"`
+	for _, line := range []string{
+		"# TYPE syncdb_exec_total counter",
+		"syncdb_exec_total 3",
+		"syncdb_commit_total 3",
+		"syncdb_rollback_total 1",
+		"syncdb_log_entries 2",
+		"# TYPE syncdb_sync_duration_seconds histogram",
+		"syncdb_sync_duration_seconds_count{" + peer + "} 1",
+		`syncdb_sync_duration_seconds_bucket{` + peer + `,le="+Inf"} 1`,
+		"# TYPE syncdb_lock_wait_seconds gauge",
+	} {
+		if !strings.Contains(m1, line+"\n") {
+			t.Error("Metric not found", line)
+		}
+	}
+
+	m2 := get(db2)
+	for _, line := range []string{
+		"syncdb_remote_txs_applied_total 1",
+		"syncdb_remote_txs_failed_total 0",
+		`syncdb_requests_total{handler="/diffs"} 1`,
+		`syncdb_requests_total{handler="/txs"} 0`,
+		"syncdb_log_entries 2",
+	} {
+		if !strings.Contains(m2, line+"\n") {
+			t.Error("Metric not found", line, m2)
+		}
+	}
+}
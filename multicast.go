@@ -0,0 +1,239 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultMulticastAddr is the group used by MulticastDiscoverer when Addr is empty
+	DefaultMulticastAddr = "239.255.77.77:7777"
+)
+
+type lanAnnounce struct {
+	Company string
+	ID      string
+	Port    string
+}
+
+type lanNode struct {
+	info     NodeInfo
+	company  string
+	lastSeen time.Time
+}
+
+//MulticastDiscoverer find the nodes of the same company on the LAN, without
+//a central service. Each node announce {company, id, port} over udp
+//multicast (or broadcast, if Addr is a broadcast address, like
+//192.168.0.255:7777) and listen for the announcements of the others.
+type MulticastDiscoverer struct {
+	//Addr is the multicast group or broadcast address, DefaultMulticastAddr if empty
+	Addr string
+	//TTL is how long an announcement is valid, 10 minutes if zero
+	TTL time.Duration
+	//Wait is how long Discover wait for answers after announce, 1 second if zero
+	Wait time.Duration
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	gaddr  *net.UDPAddr
+	self   lanAnnounce
+	nodes  map[string]lanNode
+	closed bool
+}
+
+//Discover announce this node on the LAN and return the nodes of company
+//heard until now
+func (d *MulticastDiscoverer) Discover(ips []string, company, port, id string) (map[string]NodeInfo, error) {
+	return d.DiscoverContext(context.Background(), ips, company, port, id)
+}
+
+//DiscoverContext is Discover, the wait for answers end with ctx
+func (d *MulticastDiscoverer) DiscoverContext(ctx context.Context, ips []string, company, port,
+	id string) (map[string]NodeInfo, error) {
+	d.mu.Lock()
+	d.self = lanAnnounce{Company: company, ID: id, Port: port}
+	d.mu.Unlock()
+
+	err := d.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.announce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := d.Wait
+	if wait == 0 {
+		wait = 1 * time.Second
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ttl := d.TTL
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nodes := map[string]NodeInfo{}
+	for key, node := range d.nodes {
+		if time.Since(node.lastSeen) > ttl {
+			delete(d.nodes, key)
+			continue
+		}
+		if node.company == company {
+			nodes[key] = node.info
+		}
+	}
+
+	return nodes, nil
+}
+
+//Close stop listening for announcements
+func (d *MulticastDiscoverer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Close()
+	d.conn = nil
+	return err
+}
+
+//listen start the listener goroutine once
+func (d *MulticastDiscoverer) listen() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		return nil
+	}
+
+	addr := d.Addr
+	if len(addr) == 0 {
+		addr = DefaultMulticastAddr
+	}
+	gaddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if gaddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, gaddr)
+	} else {
+		var pc net.PacketConn
+		lc := net.ListenConfig{Control: broadcastControl}
+		pc, err = lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(gaddr.Port))
+		if err == nil {
+			conn = pc.(*net.UDPConn)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	d.conn = conn
+	d.gaddr = gaddr
+	d.closed = false
+	if d.nodes == nil {
+		d.nodes = map[string]lanNode{}
+	}
+
+	go d.receive(conn)
+	return nil
+}
+
+//announce send this node info to the group
+func (d *MulticastDiscoverer) announce(ctx context.Context) error {
+	d.mu.Lock()
+	b, err := json.Marshal(d.self)
+	gaddr := d.gaddr
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if gaddr.IP.IsMulticast() {
+		conn, err := net.DialUDP("udp4", nil, gaddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(b)
+		return err
+	}
+
+	//broadcast is sent only by sockets with SO_BROADCAST
+	lc := net.ListenConfig{Control: broadcastControl}
+	conn, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo(b, gaddr)
+	return err
+}
+
+func (d *MulticastDiscoverer) receive(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if !closed {
+				log.Println("multicast discovery:", err)
+			}
+			return
+		}
+
+		msg := lanAnnounce{}
+		err = json.Unmarshal(buf[:n], &msg)
+		if err != nil || len(msg.ID) == 0 {
+			continue
+		}
+
+		d.mu.Lock()
+		if msg.ID == d.self.ID {
+			d.mu.Unlock()
+			continue
+		}
+		_, known := d.nodes[msg.ID]
+		d.nodes[msg.ID] = lanNode{
+			info:     NodeInfo{IP: src.IP.String(), Port: msg.Port},
+			company:  msg.Company,
+			lastSeen: time.Now()}
+		answer := !known && msg.Company == d.self.Company
+		d.mu.Unlock()
+
+		//a new node of our company, let it know about us
+		if answer {
+			err = d.announce(context.Background())
+			if err != nil {
+				log.Println("multicast discovery:", err)
+			}
+		}
+	}
+}
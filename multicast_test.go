@@ -0,0 +1,68 @@
+package syncdb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMulticastDiscoverer(t *testing.T) {
+	testLANDiscovery(t, "239.255.77.78:17777")
+}
+
+func TestBroadcastDiscoverer(t *testing.T) {
+	testLANDiscovery(t, "127.255.255.255:17778")
+}
+
+func testLANDiscovery(t *testing.T, addr string) {
+	d1 := &MulticastDiscoverer{Addr: addr, Wait: 500 * time.Millisecond}
+	defer d1.Close()
+	d2 := &MulticastDiscoverer{Addr: addr, Wait: 500 * time.Millisecond}
+	defer d2.Close()
+	d3 := &MulticastDiscoverer{Addr: addr, Wait: 500 * time.Millisecond}
+	defer d3.Close()
+
+	_, err := d1.Discover(nil, idcompany, "12345", node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d3.Discover(nil, "company2", "12347", "node3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := d2.Discover(nil, idcompany, "12346", node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[node1].Port != "12345" {
+		t.Error("node1 not discovered", nodes)
+	}
+	if _, ok := nodes["node3"]; ok {
+		t.Error("node of other company discovered", nodes)
+	}
+
+	//node1 must learn about node2 by its announcement
+	nodes, err = d1.Discover(nil, idcompany, "12345", node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[node2].Port != "12346" {
+		t.Error("node2 not discovered", nodes)
+	}
+}
+
+func TestMulticastDiscovererContext(t *testing.T) {
+	d := &MulticastDiscoverer{Addr: "239.255.77.79:17779", Wait: time.Minute}
+	defer d.Close()
+
+	//the wait end with ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := d.DiscoverContext(ctx, nil, idcompany, "12345", node1)
+	if err != context.DeadlineExceeded || time.Since(start) > 10*time.Second {
+		t.Error("Discover not canceled", err, time.Since(start))
+	}
+}
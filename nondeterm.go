@@ -0,0 +1,905 @@
+package syncdb
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//DeterminismPolicy is what Exec do with statements that would have other
+//results when executed again in the other nodes
+type DeterminismPolicy int
+
+const (
+	//PolicyLenient rewrite the non-deterministic parts of the statement
+	//into the values got in this node, before log it
+	PolicyLenient DeterminismPolicy = iota
+	//PolicyStrict reject non-deterministic statements
+	PolicyStrict
+)
+
+//NonDeterministicError is returned by Exec for a statement that is
+//rejected by PolicyStrict, or that PolicyLenient can't rewrite
+type NonDeterministicError struct {
+	SQL string
+	//Expr is the non-deterministic part of the statement
+	Expr string
+}
+
+func (e *NonDeterministicError) Error() string {
+	return "Non-deterministic sql: " + e.Expr + " in " + e.SQL
+}
+
+//errManyRowids is returned by implicitRowid for an INSERT of many tuples
+//without the key
+var errManyRowids = errors.New("implicit rowids of many tuples")
+
+const (
+	tokIdent = iota
+	tokString
+	tokNumber
+	tokParam
+	tokPunct
+)
+
+//sqlToken is a token of a sql statement, whitespace and comments are not
+//tokens
+type sqlToken struct {
+	kind int
+	//text is the token, without quotes for strings and quoted identifiers
+	text   string
+	quoted bool
+	pos    int
+	end    int
+	//param is the index of the parameter, from 1
+	param int
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+//tokenize split sql in tokens, the parameters are numbered like sqlite do
+func tokenize(sql string) []sqlToken {
+	toks := []sqlToken{}
+	named := map[string]int{}
+	maxParam := 0
+
+	quoted := func(i int, close byte) int {
+		for j := i + 1; j < len(sql); j++ {
+			if sql[j] == close {
+				if close != ']' && j+1 < len(sql) && sql[j+1] == close {
+					j++
+					continue
+				}
+				return j + 1
+			}
+		}
+		return len(sql)
+	}
+	unquote := func(s string, close byte) string {
+		if len(s) < 2 {
+			return s
+		}
+		s = s[1 : len(s)-1]
+		if close != ']' {
+			c := string(close)
+			s = strings.Replace(s, c+c, c, -1)
+		}
+		return s
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case (c == 'x' || c == 'X') && i+1 < len(sql) && sql[i+1] == '\'':
+			end := quoted(i+1, '\'')
+			toks = append(toks, sqlToken{kind: tokString, text: sql[i:end], pos: i, end: end})
+			i = end
+		case c == '\'':
+			end := quoted(i, '\'')
+			toks = append(toks, sqlToken{kind: tokString, text: unquote(sql[i:end], '\''), pos: i, end: end})
+			i = end
+		case c == '"' || c == '`' || c == '[':
+			close := c
+			if c == '[' {
+				close = ']'
+			}
+			end := quoted(i, close)
+			toks = append(toks, sqlToken{kind: tokIdent, text: unquote(sql[i:end], close), quoted: true,
+				pos: i, end: end})
+			i = end
+		case (c >= '0' && c <= '9') || (c == '.' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9'):
+			end := i + 1
+			for end < len(sql) && (isIdentChar(sql[end]) || sql[end] == '.' ||
+				((sql[end] == '+' || sql[end] == '-') && (sql[end-1] == 'e' || sql[end-1] == 'E'))) {
+				end++
+			}
+			toks = append(toks, sqlToken{kind: tokNumber, text: sql[i:end], pos: i, end: end})
+			i = end
+		case c == '?':
+			end := i + 1
+			for end < len(sql) && sql[end] >= '0' && sql[end] <= '9' {
+				end++
+			}
+			n := maxParam + 1
+			if end > i+1 {
+				n, _ = strconv.Atoi(sql[i+1 : end])
+			}
+			if n > maxParam {
+				maxParam = n
+			}
+			toks = append(toks, sqlToken{kind: tokParam, text: sql[i:end], pos: i, end: end, param: n})
+			i = end
+		case (c == ':' || c == '@' || c == '$') && i+1 < len(sql) && isIdentChar(sql[i+1]):
+			end := i + 1
+			for end < len(sql) && isIdentChar(sql[end]) {
+				end++
+			}
+			n, ok := named[sql[i:end]]
+			if !ok {
+				maxParam++
+				n = maxParam
+				named[sql[i:end]] = n
+			}
+			toks = append(toks, sqlToken{kind: tokParam, text: sql[i:end], pos: i, end: end, param: n})
+			i = end
+		case isIdentChar(c):
+			end := i + 1
+			for end < len(sql) && isIdentChar(sql[end]) {
+				end++
+			}
+			toks = append(toks, sqlToken{kind: tokIdent, text: sql[i:end], pos: i, end: end})
+			i = end
+		default:
+			toks = append(toks, sqlToken{kind: tokPunct, text: sql[i : i+1], pos: i, end: i + 1})
+			i++
+		}
+	}
+
+	return toks
+}
+
+//is report if the token is the keyword or punctuation s
+func (t sqlToken) is(s string) bool {
+	return !t.quoted && (t.kind == tokIdent || t.kind == tokPunct) && strings.EqualFold(t.text, s)
+}
+
+//closing return the index of the ")" closing the "(" at toks[open]
+func closing(toks []sqlToken, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch {
+		case toks[i].is("("):
+			depth++
+		case toks[i].is(")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+//sqlEdit replace sql[pos:end] by text
+type sqlEdit struct {
+	pos, end int
+	text     string
+}
+
+func applyEdits(sql string, edits []sqlEdit) string {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].pos > edits[j].pos })
+	for _, e := range edits {
+		sql = sql[:e.pos] + e.text + sql[e.end:]
+	}
+	return sql
+}
+
+//paramValue return the value bound to the parameter of the token
+func paramValue(t sqlToken, params []interface{}) (interface{}, bool) {
+	if t.kind != tokParam || t.param < 1 || t.param > len(params) {
+		return nil, false
+	}
+	return params[t.param-1], true
+}
+
+var (
+	nonDeterministicFuncs = map[string]bool{
+		"random":            true,
+		"randomblob":        true,
+		"last_insert_rowid": true,
+		"changes":           true,
+		"total_changes":     true,
+	}
+
+	//dateFuncs are non-deterministic with 'now' or without the time value,
+	//the argument in the position mapped
+	dateFuncs = map[string]int{
+		"date":      1,
+		"time":      1,
+		"datetime":  1,
+		"julianday": 1,
+		"strftime":  2,
+	}
+
+	currentKeywords = map[string]bool{
+		"current_timestamp": true,
+		"current_date":      true,
+		"current_time":      true,
+	}
+
+	//perRowFuncs have other result for each row changed by the statement,
+	//'now' and CURRENT_* are the same in all the statement
+	perRowFuncs = map[string]bool{
+		"random":            true,
+		"randomblob":        true,
+		"last_insert_rowid": true,
+		"changes":           true,
+		"total_changes":     true,
+	}
+
+	rowidNames = map[string]bool{
+		"rowid":   true,
+		"oid":     true,
+		"_rowid_": true,
+	}
+)
+
+//nonDeterministicCall is a call, or CURRENT_* keyword, in toks[from:to+1]
+type nonDeterministicCall struct {
+	from, to int
+	name     string
+}
+
+//nonDeterministicCalls find the calls with results different in each node
+func nonDeterministicCalls(toks []sqlToken, params []interface{}) []nonDeterministicCall {
+	calls := []nonDeterministicCall{}
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.kind != tokIdent || t.quoted || (i > 0 && toks[i-1].is(".")) {
+			continue
+		}
+		name := strings.ToLower(t.text)
+		call := i+1 < len(toks) && toks[i+1].is("(")
+
+		if !call {
+			if currentKeywords[name] {
+				calls = append(calls, nonDeterministicCall{from: i, to: i, name: name})
+			}
+			continue
+		}
+
+		end := closing(toks, i+1)
+		if end < 0 {
+			break
+		}
+
+		found := nonDeterministicFuncs[name]
+		if dateFuncs[name] > 0 {
+			//without the time value it is now
+			args := 0
+			if end > i+2 {
+				args = 1
+			}
+			for j := i + 2; j < end; j++ {
+				if toks[j].is("(") {
+					j = closing(toks, j)
+				} else if toks[j].is(",") {
+					args++
+				}
+			}
+			found = args < dateFuncs[name]
+			for _, arg := range toks[i+2 : end] {
+				v, _ := paramValue(arg, params)
+				if s, ok := v.(string); ok && strings.EqualFold(strings.TrimSpace(s), "now") {
+					found = true
+				}
+				if arg.kind == tokString && strings.EqualFold(strings.TrimSpace(arg.text), "now") {
+					found = true
+				}
+			}
+		}
+
+		if found {
+			calls = append(calls, nonDeterministicCall{from: i, to: end, name: name})
+			i = end
+		}
+	}
+	return calls
+}
+
+//sqlLiteral format v as a sql literal
+func sqlLiteral(v interface{}, blob bool) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		s := strconv.FormatFloat(val, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case []byte:
+		if blob {
+			return "X'" + hex.EncodeToString(val) + "'"
+		}
+		return quoteLiteral(string(val))
+	case string:
+		return quoteLiteral(val)
+	default:
+		return quoteLiteral(fmt.Sprint(val))
+	}
+}
+
+//exprText return the text of the expression in toks, the parameters
+//numbered, and the last parameter used
+func exprText(sql string, toks []sqlToken) (string, int) {
+	if len(toks) == 0 {
+		return "", 0
+	}
+
+	expr := ""
+	last := toks[0].pos
+	maxParam := 0
+	for _, t := range toks {
+		if t.kind != tokParam {
+			continue
+		}
+		expr += sql[last:t.pos] + "?" + strconv.Itoa(t.param)
+		last = t.end
+		if t.param > maxParam {
+			maxParam = t.param
+		}
+	}
+	return expr + sql[last:toks[len(toks)-1].end], maxParam
+}
+
+//evalCall get the value of the call in this node, it fail for calls
+//using columns of the statement
+func (tx *Tx) evalCall(sql string, toks []sqlToken, call nonDeterministicCall,
+	params []interface{}) (string, error) {
+
+	expr, maxParam := exprText(sql, toks[call.from:call.to+1])
+	if maxParam > len(params) {
+		return "", &NonDeterministicError{SQL: sql, Expr: expr}
+	}
+
+	var v interface{}
+	err := tx.tx.QueryRow("SELECT "+expr, params[:maxParam]...).Scan(&v)
+	if err != nil {
+		return "", &NonDeterministicError{SQL: sql, Expr: expr}
+	}
+
+	return sqlLiteral(v, call.name == "randomblob"), nil
+}
+
+//insertStmt is an INSERT statement split in its parts
+type insertStmt struct {
+	table string
+	//cols are the columns listed, nil without the list
+	cols     []sqlToken
+	colsOpen int
+	//tuples are the VALUES, each value a list of tokens, and tupleOpen the
+	//index of the "(" of each tuple
+	tuples    [][][]sqlToken
+	tupleOpen []int
+	//defaults is the index of DEFAULT VALUES, -1 without it
+	defaults int
+	//selects report if the values come from a SELECT
+	selects bool
+	upsert  bool
+}
+
+//parseInsert split the INSERT statement, it return nil for other statements
+func parseInsert(toks []sqlToken) *insertStmt {
+	i := 0
+	next := func(s string) bool {
+		if i < len(toks) && toks[i].is(s) {
+			i++
+			return true
+		}
+		return false
+	}
+
+	switch {
+	case next("INSERT"):
+		if next("OR") {
+			i++
+		}
+		if !next("INTO") {
+			return nil
+		}
+	case next("REPLACE"):
+		if !next("INTO") {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if i >= len(toks) || toks[i].kind != tokIdent {
+		return nil
+	}
+	stmt := &insertStmt{table: toks[i].text, colsOpen: -1, defaults: -1}
+	i++
+	if next(".") {
+		if i >= len(toks) {
+			return nil
+		}
+		stmt.table = toks[i].text
+		i++
+	}
+
+	if next("AS") {
+		i++
+	}
+
+	if i < len(toks) && toks[i].is("(") {
+		stmt.colsOpen = i
+		end := closing(toks, i)
+		if end < 0 {
+			return nil
+		}
+		stmt.cols = []sqlToken{}
+		for j := i + 1; j < end; j++ {
+			if !toks[j].is(",") {
+				stmt.cols = append(stmt.cols, toks[j])
+			}
+		}
+		i = end + 1
+	}
+
+	if i+1 < len(toks) && toks[i].is("DEFAULT") && toks[i+1].is("VALUES") {
+		stmt.defaults = i
+		return stmt
+	}
+
+	if !next("VALUES") {
+		stmt.selects = true
+		return stmt
+	}
+
+	for i < len(toks) && toks[i].is("(") {
+		end := closing(toks, i)
+		if end < 0 {
+			return nil
+		}
+
+		values := [][]sqlToken{{}}
+		for j := i + 1; j < end; j++ {
+			if toks[j].is(",") {
+				values = append(values, []sqlToken{})
+				continue
+			}
+			values[len(values)-1] = append(values[len(values)-1], toks[j])
+			if toks[j].is("(") {
+				k := closing(toks, j)
+				if k < 0 {
+					return nil
+				}
+				values[len(values)-1] = append(values[len(values)-1], toks[j+1:k+1]...)
+				j = k
+			}
+		}
+		stmt.tuples = append(stmt.tuples, values)
+		stmt.tupleOpen = append(stmt.tupleOpen, i)
+
+		i = end + 1
+		if !next(",") {
+			break
+		}
+	}
+
+	for ; i+1 < len(toks); i++ {
+		if toks[i].is("ON") && toks[i+1].is("CONFLICT") {
+			stmt.upsert = true
+		}
+	}
+
+	return stmt
+}
+
+//colIndex return the position of the column in the values of the
+//statement, -1 if it is not set. The rowid names match the alias
+func (stmt *insertStmt) colIndex(col string, info tableInfo) int {
+	if stmt.cols == nil {
+		for i, c := range info.cols {
+			if c != "rowid" && strings.EqualFold(c, col) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for i, t := range stmt.cols {
+		if t.kind != tokIdent {
+			continue
+		}
+		if strings.EqualFold(t.text, col) {
+			return i
+		}
+		if col == info.alias && !t.quoted && (strings.EqualFold(t.text, "rowid") ||
+			strings.EqualFold(t.text, "oid") || strings.EqualFold(t.text, "_rowid_")) {
+			return i
+		}
+	}
+	return -1
+}
+
+//oneRow report if the call is evaluated for one row only: in a tuple of
+//INSERT ... VALUES, or in an UPDATE or DELETE of one row by its key
+func (tx *Tx) oneRow(toks []sqlToken, call nonDeterministicCall) (bool, error) {
+	stmt := parseInsert(toks)
+	if stmt != nil {
+		if stmt.selects || stmt.defaults >= 0 {
+			return false, nil
+		}
+		for _, open := range stmt.tupleOpen {
+			if open < call.from && call.to < closing(toks, open) {
+				return true, nil
+			}
+		}
+		return len(stmt.tuples) == 1, nil
+	}
+	return tx.keyWhere(toks)
+}
+
+//keyWhere report if the UPDATE or DELETE change one row at most: its
+//WHERE compare all the key columns with =, joined by AND
+func (tx *Tx) keyWhere(toks []sqlToken) (bool, error) {
+	i := 0
+	switch {
+	case len(toks) > 2 && toks[0].is("UPDATE"):
+		i = 1
+		if toks[i].is("OR") {
+			i += 2
+		}
+	case len(toks) > 2 && toks[0].is("DELETE") && toks[1].is("FROM"):
+		i = 2
+	default:
+		return false, nil
+	}
+	if i >= len(toks) || toks[i].kind != tokIdent {
+		return false, nil
+	}
+	table := toks[i].text
+	if i+2 < len(toks) && toks[i+1].is(".") {
+		table = toks[i+2].text
+	}
+
+	where := -1
+	for j := i; j < len(toks) && where < 0; j++ {
+		if toks[j].is("(") {
+			j = closing(toks, j)
+			if j < 0 {
+				return false, nil
+			}
+		} else if toks[j].is("WHERE") {
+			where = j
+		}
+	}
+	if where < 0 {
+		return false, nil
+	}
+
+	info, err := tx.tableInfo(table)
+	if err != nil || len(info.key) == 0 {
+		return false, err
+	}
+
+	fixed := map[string]bool{}
+	for j := where + 1; j < len(toks); j++ {
+		if toks[j].kind != tokIdent {
+			return false, nil
+		}
+		col := toks[j].text
+		j++
+		if j+1 < len(toks) && toks[j].is(".") {
+			col = toks[j+1].text
+			j += 2
+		}
+		if j >= len(toks) || !toks[j].is("=") {
+			return false, nil
+		}
+
+		start := j + 1
+		for j = start; j < len(toks) && !toks[j].is("AND") && !toks[j].is("RETURNING") &&
+			!toks[j].is("ORDER") && !toks[j].is("LIMIT"); j++ {
+			if toks[j].is("OR") {
+				return false, nil
+			}
+			if toks[j].is("(") {
+				j = closing(toks, j)
+				if j < 0 {
+					return false, nil
+				}
+			}
+		}
+		if j == start {
+			return false, nil
+		}
+
+		col = strings.ToLower(col)
+		if info.rowid && rowidNames[col] {
+			col = strings.ToLower(info.alias)
+			if len(col) == 0 {
+				col = "rowid"
+			}
+		}
+		fixed[col] = true
+		if j < len(toks) && !toks[j].is("AND") {
+			break
+		}
+	}
+
+	for _, key := range info.key {
+		if !fixed[strings.ToLower(key)] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//rowidRewrite return the statement and params with the rowid allocated
+//by sqlite
+type rowidRewrite func(id int64) (string, []interface{})
+
+//implicitRowid check if the INSERT let sqlite allocate the INTEGER PRIMARY
+//KEY. Then it return how to rewrite the statement with the allocated value.
+//With many tuples the keys are allocated before, see allocRowids
+func (tx *Tx) implicitRowid(sql string, toks []sqlToken, params []interface{}) (rowidRewrite, error) {
+	stmt := parseInsert(toks)
+	//settings are local, its ids are not the same in all nodes
+	if stmt == nil || strings.EqualFold(stmt.table, "SETTINGS") {
+		return nil, nil
+	}
+
+	info, err := tx.tableInfo(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.alias) == 0 {
+		return nil, nil
+	}
+
+	pos := stmt.colIndex(info.alias, info)
+	implicit := &NonDeterministicError{SQL: sql, Expr: "implicit rowid of " + stmt.table}
+
+	switch {
+	case stmt.defaults >= 0:
+		from, to := toks[stmt.defaults].pos, toks[stmt.defaults+1].end
+		return func(id int64) (string, []interface{}) {
+			return applyEdits(sql, []sqlEdit{{from, to,
+				"(" + quoteIdent(info.alias) + ") VALUES (" + strconv.FormatInt(id, 10) + ")"}}), params
+		}, nil
+
+	case stmt.selects && pos < 0:
+		return nil, implicit
+
+	case stmt.selects:
+		return nil, nil
+	}
+
+	var rewrite rowidRewrite
+	for n, values := range stmt.tuples {
+		switch {
+		case pos < 0 && stmt.colsOpen >= 0:
+			valuesOpen, colsAt := toks[stmt.tupleOpen[n]].end, toks[stmt.colsOpen].end
+			rewrite = func(id int64) (string, []interface{}) {
+				return applyEdits(sql, []sqlEdit{
+					{colsAt, colsAt, quoteIdent(info.alias) + ", "},
+					{valuesOpen, valuesOpen, strconv.FormatInt(id, 10) + ", "}}), params
+			}
+		case pos < len(values) && len(values[pos]) == 1 && values[pos][0].is("NULL"):
+			null := values[pos][0]
+			rewrite = func(id int64) (string, []interface{}) {
+				return applyEdits(sql, []sqlEdit{{null.pos, null.end, strconv.FormatInt(id, 10)}}), params
+			}
+		case pos < len(values) && len(values[pos]) == 1 && values[pos][0].kind == tokParam:
+			v, ok := paramValue(values[pos][0], params)
+			if ok && v == nil {
+				param := values[pos][0].param
+				rewrite = func(id int64) (string, []interface{}) {
+					p := make([]interface{}, len(params))
+					copy(p, params)
+					p[param-1] = id
+					return sql, p
+				}
+			}
+		}
+	}
+
+	if rewrite == nil {
+		return nil, nil
+	}
+
+	//an upsert can update a row instead of insert it
+	if stmt.upsert {
+		return nil, implicit
+	}
+
+	//only the last rowid allocated is known after the execution
+	if len(stmt.tuples) > 1 {
+		return nil, errManyRowids
+	}
+
+	return rewrite, nil
+}
+
+//allocRowids rewrite the INSERT of many tuples with the INTEGER PRIMARY
+//KEY allocated as sqlite do: after the largest rowid (or the AUTOINCREMENT
+//sequence), in order of the tuples. It fail for keys of other expressions
+func (tx *Tx) allocRowids(sql string, toks []sqlToken, params []interface{}) (string, []interface{}, error) {
+	stmt := parseInsert(toks)
+	info, err := tx.tableInfo(stmt.table)
+	if err != nil {
+		return "", nil, err
+	}
+	implicit := &NonDeterministicError{SQL: sql, Expr: "implicit rowid of " + stmt.table}
+
+	res, _, err := tx.Query("SELECT IFNULL(MAX(rowid), 0) FROM "+quoteIdent(stmt.table), []interface{}{})
+	if err != nil {
+		return "", nil, err
+	}
+	last, _ := strconv.ParseInt(*res[0][0].(*string), 10, 64)
+
+	res, _, err = tx.Query(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE
+		AND upper(sql) LIKE '%AUTOINCREMENT%'`, []interface{}{stmt.table})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(res) > 0 {
+		res, _, err = tx.Query("SELECT IFNULL(MAX(seq), 0) FROM sqlite_sequence WHERE name = ? COLLATE NOCASE",
+			[]interface{}{stmt.table})
+		if err != nil {
+			return "", nil, err
+		}
+		seq, _ := strconv.ParseInt(*res[0][0].(*string), 10, 64)
+		if seq > last {
+			last = seq
+		}
+	}
+
+	next := func() (string, error) {
+		if last == math.MaxInt64 {
+			return "", implicit
+		}
+		last++
+		return strconv.FormatInt(last, 10), nil
+	}
+
+	edits := []sqlEdit{}
+	p := make([]interface{}, len(params))
+	copy(p, params)
+	pos := stmt.colIndex(info.alias, info)
+	if pos < 0 {
+		at := toks[stmt.colsOpen].end
+		edits = append(edits, sqlEdit{at, at, quoteIdent(info.alias) + ", "})
+	}
+	for n, values := range stmt.tuples {
+		if pos < 0 {
+			id, err := next()
+			if err != nil {
+				return "", nil, err
+			}
+			at := toks[stmt.tupleOpen[n]].end
+			edits = append(edits, sqlEdit{at, at, id + ", "})
+			continue
+		}
+		if pos >= len(values) || len(values[pos]) != 1 {
+			return "", nil, implicit
+		}
+
+		key := values[pos][0]
+		v, isParam := paramValue(key, params)
+		switch {
+		case key.is("NULL") || (isParam && v == nil):
+			id, err := next()
+			if err != nil {
+				return "", nil, err
+			}
+			if isParam {
+				p[key.param-1] = last
+			} else {
+				edits = append(edits, sqlEdit{key.pos, key.end, id})
+			}
+			continue
+		case key.kind == tokNumber:
+			v, err = strconv.ParseInt(key.text, 10, 64)
+			if err != nil {
+				return "", nil, implicit
+			}
+		}
+
+		//the keys given move the allocation after them
+		switch k := v.(type) {
+		case int64:
+			if k > last {
+				last = k
+			}
+		case int:
+			if int64(k) > last {
+				last = int64(k)
+			}
+		default:
+			return "", nil, implicit
+		}
+	}
+
+	return applyEdits(sql, edits), p, nil
+}
+
+//deterministic check sql and, with PolicyLenient, rewrite the calls with
+//results different in each node into literals. The rowid allocated by
+//sqlite is known only after the execution, so it return how to rewrite it;
+//for an INSERT of many tuples the rowids are allocated before, in the
+//statement returned. Calls are evaluated once per statement, so random()
+//and the other calls with a result for each row are rejected in
+//statements that can change many rows
+func (tx *Tx) deterministic(sql string, params []interface{}) (string, []interface{}, rowidRewrite, error) {
+	toks := tokenize(sql)
+
+	calls := nonDeterministicCalls(toks, params)
+	if len(calls) > 0 && tx.db.determinism == PolicyStrict {
+		call := calls[0]
+		return "", nil, nil, &NonDeterministicError{SQL: sql, Expr: sql[toks[call.from].pos:toks[call.to].end]}
+	}
+
+	edits := []sqlEdit{}
+	for _, call := range calls {
+		if perRowFuncs[call.name] {
+			one, err := tx.oneRow(toks, call)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			if !one {
+				return "", nil, nil, &NonDeterministicError{SQL: sql,
+					Expr: sql[toks[call.from].pos:toks[call.to].end] + " for many rows"}
+			}
+		}
+
+		lit, err := tx.evalCall(sql, toks, call, params)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		edits = append(edits, sqlEdit{toks[call.from].pos, toks[call.to].end, lit})
+	}
+	if len(edits) > 0 {
+		sql = applyEdits(sql, edits)
+		toks = tokenize(sql)
+	}
+
+	rewrite, err := tx.implicitRowid(sql, toks, params)
+	if (rewrite != nil || err == errManyRowids) && tx.db.determinism == PolicyStrict {
+		return "", nil, nil, &NonDeterministicError{SQL: sql, Expr: "implicit rowid"}
+	}
+	if err == errManyRowids {
+		sql, params, err = tx.allocRowids(sql, toks, params)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return sql, params, rewrite, nil
+}
@@ -0,0 +1,208 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	toks := tokenize(`select "random"(), 'now', x'00', ?, ?5, :a, ? -- random()
+		from [t] /* datetime() */ where :a`)
+
+	texts := []string{}
+	params := []int{}
+	for _, tok := range toks {
+		texts = append(texts, tok.text)
+		if tok.kind == tokParam {
+			params = append(params, tok.param)
+		}
+	}
+
+	if strings.Join(texts, " ") != "select random ( ) , now , x'00' , ? , ?5 , :a , ? from t where :a" {
+		t.Error("Wrong tokens", texts)
+	}
+	if len(params) != 5 || params[0] != 1 || params[1] != 5 || params[2] != 6 || params[3] != 7 || params[4] != 6 {
+		t.Error("Wrong params", params)
+	}
+}
+
+func loggedSQLs(t *testing.T, db *SyncDB) []SQLreg {
+	tx, _ := db.BeginForQuery()
+	defer tx.Commit()
+
+	rows, _, err := tx.Query("SELECT SQL FROM __DBLOG__ ORDER BY DATETIME, SEQ", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regs := []SQLreg{}
+	for _, row := range rows {
+		reg := SQLreg{}
+		err = json.Unmarshal([]byte(*row[0].(*string)), &reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		regs = append(regs, reg)
+	}
+	return regs
+}
+
+func TestNonDeterministicLenient(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer primary key, name text, at text)", []interface{}{})
+	sqls := []string{
+		"insert into foo values (NULL, ?, datetime('now'))",
+		"insert into foo values (?, ?, NULL)",
+		"insert into foo(name, at) values ('c', datetime(?, '+1 day'))",
+		"insert into foo default values",
+		"update foo set at = CURRENT_DATE where name = 'random()'",
+		"insert into foo(name) values ('d'), ('e')",
+		"insert into foo values (NULL, 'f', NULL), (20, 'g', NULL), (?, hex(randomblob(2)), NULL)",
+		"update foo set at = random() where id = ?",
+	}
+	params := [][]interface{}{{"a"}, {nil, "b"}, {"2018-11-20"}, {}, {}, {}, {nil}, {1}}
+	for i, sql := range sqls {
+		err = tx.Exec(sql, params[i])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	//random() is one value for all the rows changed
+	rejected := []string{
+		"insert into foo(name) select name from foo",
+		"insert into foo(id, name) select id + 100, random() from foo",
+		"update foo set at = random()",
+		"update foo set at = random() where id = 1 or id = 2",
+		"update foo set at = random() where id >= 1",
+		"delete from foo where id < abs(random())",
+	}
+	for _, sql := range rejected {
+		err = tx.Exec(sql, []interface{}{})
+		if _, ok := err.(*NonDeterministicError); !ok {
+			t.Error("Expected NonDeterministicError", sql, err)
+		}
+	}
+	tx.Commit()
+
+	regs := loggedSQLs(t, db)
+	if len(regs) != 9 {
+		t.Fatal("Wrong number of logged sqls", len(regs))
+	}
+
+	if !strings.HasPrefix(regs[1].SQL, "insert into foo values (1, ?, '") || strings.Contains(regs[1].SQL, "now") {
+		t.Error("Wrong rewrite", regs[1].SQL)
+	}
+	if regs[2].SQL != sqls[1] || regs[2].Params[0] != 2.0 {
+		t.Error("Wrong rewrite", regs[2].SQL, regs[2].Params)
+	}
+	if regs[3].SQL != `insert into foo("id", name, at) values (3, 'c', datetime(?, '+1 day'))` {
+		t.Error("Wrong rewrite", regs[3].SQL)
+	}
+	if regs[4].SQL != `insert into foo ("id") VALUES (4)` {
+		t.Error("Wrong rewrite", regs[4].SQL)
+	}
+	if strings.Contains(regs[5].SQL, "CURRENT_DATE") || !strings.Contains(regs[5].SQL, "'random()'") {
+		t.Error("Wrong rewrite", regs[5].SQL)
+	}
+	if regs[6].SQL != `insert into foo("id", name) values (5, 'd'), (6, 'e')` {
+		t.Error("Wrong rewrite", regs[6].SQL)
+	}
+	if !strings.HasPrefix(regs[7].SQL, "insert into foo values (7, 'f', NULL), (20, 'g', NULL), (?, hex(X'") ||
+		regs[7].Params[0] != 21.0 {
+		t.Error("Wrong rewrite", regs[7].SQL, regs[7].Params)
+	}
+	if strings.Contains(regs[8].SQL, "random") {
+		t.Error("Wrong rewrite", regs[8].SQL)
+	}
+
+	//the logged sqls make the same rows in other node
+	db2, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close(context.Background())
+
+	tx, _ = db2.Begin()
+	for _, reg := range regs {
+		err = tx.ExecWithoutLog(reg.SQL, reg.Params)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	tx.Commit()
+
+	sql := "select id, name, at from foo order by id"
+	if dump(t, db, sql) != dump(t, db2, sql) {
+		t.Error("Nodes differ", dump(t, db, sql), dump(t, db2, sql))
+	}
+
+	//AUTOINCREMENT don't reuse the keys deleted
+	tx, _ = db.Begin()
+	tx.Exec("create table bar(id integer primary key autoincrement, n int)", []interface{}{})
+	tx.Exec("insert into bar values (NULL, 1), (NULL, 2)", []interface{}{})
+	tx.Exec("delete from bar where id = 2", []interface{}{})
+	err = tx.Exec("insert into bar(n) values (3), (4)", []interface{}{})
+	if err != nil {
+		t.Error(err)
+	}
+	tx.Commit()
+	if ids := dump(t, db, "select group_concat(id) from bar"); ids != `[["1,3,4"]]` {
+		t.Error("Wrong autoincrement keys", ids)
+	}
+}
+
+func TestNonDeterministicStrict(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, Determinism: PolicyStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	defer tx.Commit()
+
+	err = tx.Exec("create table foo(id integer primary key, name text, at text default current_timestamp)",
+		[]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := map[string][]interface{}{
+		"insert into foo values (NULL, 'a', NULL)":           {},
+		"insert into foo(name) values (?)":                   {"a"},
+		"insert into foo values (?, 'a', NULL)":              {nil},
+		"insert into foo values (1, 'a', datetime(?))":       {"now"},
+		"insert into foo values (1, 'a', strftime('%s'))":    {},
+		"update foo set name = hex(randomblob(4))":           {},
+		"update foo set id = last_insert_rowid() + random()": {},
+	}
+	for sql, params := range rejected {
+		err = tx.Exec(sql, params)
+		if _, ok := err.(*NonDeterministicError); !ok {
+			t.Error("Expected NonDeterministicError", sql, err)
+		}
+	}
+
+	accepted := map[string][]interface{}{
+		"insert into foo values (1, 'a', datetime(?))":               {"2018-11-20"},
+		"insert into foo values (?, 'datetime(''now'')', NULL)":      {2},
+		`insert into foo("id", name) values (3, "random")`:           {},
+		"update foo set at = datetime(at, '+1 day') where id = 1":    {},
+		"insert into foo(rowid, name) select id + 10, name from foo": {},
+	}
+	for sql, params := range accepted {
+		err = tx.Exec(sql, params)
+		if err != nil {
+			t.Error(sql, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package syncdb
+
+import (
+	"encoding/json"
+)
+
+//PeerInfo is what this node know about a peer, from the last contact
+type PeerInfo struct {
+	ID string
+	//Addr is the "host:port" of the peer, empty while it only contacted
+	//this node
+	Addr     string
+	LastSeen string
+	//Acked is the high-water mark of the txs of each origin the peer has
+	Acked  map[string]int64
+	Legacy string
+	//Lag is the number of txs of this node the peer don't have
+	Lag int64
+}
+
+//recordPeer save the vector of the peer, the txs it acknowledged. An
+//empty addr keep the address known
+func (db *SyncDB) recordPeer(v syncVector, addr string) error {
+	id, err := db.nodeID()
+	if err != nil {
+		return err
+	}
+	if len(v.ID) == 0 || v.ID == id {
+		return nil
+	}
+
+	b, err := json.Marshal(v.Seqs)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	return tx.ExecWithoutLog(`INSERT INTO __DBPEER__(ID, ADDR, VECTOR, LEGACY, LASTSEEN)
+		VALUES (?, ?, ?, ?, datetime('now'))
+		ON CONFLICT(ID) DO UPDATE SET ADDR = CASE WHEN excluded.ADDR = '' THEN ADDR ELSE excluded.ADDR END,
+		VECTOR = excluded.VECTOR, LEGACY = excluded.LEGACY, LASTSEEN = excluded.LASTSEEN`,
+		[]interface{}{v.ID, addr, string(b), v.Legacy})
+}
+
+//ForgetPeer remove the peer from the known peers, its acknowledgement is
+//not waited anymore to prune txs
+func (db *SyncDB) ForgetPeer(id string) error {
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	return tx.ExecWithoutLog("DELETE FROM __DBPEER__ WHERE ID = ?", []interface{}{id})
+}
+
+//peers return the peers with the condition and their lag, it must be in a
+//transaction
+func (tx *Tx) peers(where string, params []interface{}) ([]PeerInfo, error) {
+	local, err := tx.vector()
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := tx.Query(`SELECT ID, ADDR, VECTOR, LEGACY, LASTSEEN FROM __DBPEER__ `+where+` ORDER BY ID`,
+		params)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []PeerInfo{}
+	for _, row := range res {
+		p := PeerInfo{ID: *row[0].(*string), Addr: *row[1].(*string), Legacy: *row[3].(*string),
+			LastSeen: *row[4].(*string), Acked: map[string]int64{}}
+		err = json.Unmarshal([]byte(*row[2].(*string)), &p.Acked)
+		if err != nil {
+			return nil, err
+		}
+		for origin, seq := range local.Seqs {
+			if seq > p.Acked[origin] {
+				p.Lag += seq - p.Acked[origin]
+			}
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+//Peers return the known peers, with the txs they acknowledged and how
+//many txs of this node they don't have
+func (db *SyncDB) Peers() ([]PeerInfo, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	return tx.peers("", []interface{}{})
+}
@@ -0,0 +1,110 @@
+package syncdb
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPeers(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(db2.port))
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//db1 know the vector of db2 before the sync
+	peers, err := db1.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != node2 || peers[0].Addr != addr || peers[0].Lag != 1 {
+		t.Error("Wrong peers", peers)
+	}
+
+	//db2 know db1 by its messages
+	peers, _ = db2.Peers()
+	if len(peers) != 1 || peers[0].ID != node1 || peers[0].Addr != "" || peers[0].Acked[node1] != 1 ||
+		peers[0].Lag != 0 {
+		t.Error("Wrong peers of server", peers)
+	}
+
+	err = db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, _ = db1.Peers()
+	if len(peers) != 1 || peers[0].Acked[node1] != 1 || peers[0].Lag != 0 {
+		t.Error("Acknowledgement not updated", peers)
+	}
+
+	//a new tx is not acknowledged
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Commit()
+	peers, _ = db1.Peers()
+	if len(peers) != 1 || peers[0].Lag != 1 {
+		t.Error("New tx acknowledged", peers)
+	}
+
+	db1.ForgetPeer(node2)
+	peers, _ = db1.Peers()
+	if len(peers) != 0 {
+		t.Error("Peer not forgotten", peers)
+	}
+}
+
+func TestSyncPeerAhead(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	//127.0.0.1 is skipped by Sync
+	db1.Discoverer = StaticDiscoverer{node2: NodeInfo{IP: "localhost", Port: strconv.Itoa(db2.port)}}
+
+	tx, _ := db2.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	err := db1.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//db2 acknowledged all txs of db1, but it has new txs
+	tx, _ = db2.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Exec("insert into foo values (3, ?)", []interface{}{"teste3"})
+	tx.Commit()
+
+	err = db1.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := dump(t, db1, "select count(*) from foo"); n != `[["3"]]` {
+		t.Error("Txs of the peer not received", n)
+	}
+
+	//with the same txs only the vector is requested
+	diffs := db2.metrics.requests["/diffs"]
+	err = db1.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db2.metrics.requests["/diffs"] != diffs {
+		t.Error("Txs exchanged with node up to date")
+	}
+}
@@ -0,0 +1,270 @@
+package syncdb
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrNoCheckpoint is returned by Prune before the first checkpoint
+	ErrNoCheckpoint = errors.New("No checkpoint recorded")
+
+	//ErrPruneTotalOrder is returned by Prune in total order mode, the
+	//database is rebuilt from the full log
+	ErrPruneTotalOrder = errors.New("Prune not allowed in total order mode")
+
+	//ErrBootstrapRequired is returned by the sync with a node that pruned
+	//txs this node don't have, they can only come by BootstrapFrom
+	ErrBootstrapRequired = errors.New("node pruned txs not received, bootstrap required (BootstrapFrom)")
+)
+
+//legacyTTL is how long the ids of the pruned txs are kept after the last
+//contact with older nodes
+const legacyTTL = "-30 days"
+
+//Checkpoint is a snapshot marker: the version vector of the database when
+//it was recorded. Txs before it can be pruned
+type Checkpoint struct {
+	ID       int64
+	Datetime string
+	Seqs     map[string]int64
+}
+
+//prunedMarks return the last sequence pruned of each origin, it must be in
+//a transaction
+func (tx *Tx) prunedMarks() (map[string]int64, error) {
+	res, _, err := tx.Query("SELECT ORIGIN, OSEQ FROM __DBPRUNED__", []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	marks := map[string]int64{}
+	for _, row := range res {
+		marks[*row[0].(*string)], _ = strconv.ParseInt(*row[1].(*string), 10, 64)
+	}
+	return marks, nil
+}
+
+//Checkpoint record a snapshot marker with the current version vector
+func (db *SyncDB) Checkpoint() (Checkpoint, error) {
+	cp := Checkpoint{}
+	tx, err := db.beginInternal()
+	if err != nil {
+		return cp, err
+	}
+	defer tx.Commit()
+
+	v, err := tx.vector()
+	if err != nil {
+		return cp, err
+	}
+
+	b, err := json.Marshal(v.Seqs)
+	if err != nil {
+		return cp, err
+	}
+
+	err = tx.ExecWithoutLog("INSERT INTO __DBCHECKPOINT__(DATETIME, VECTOR) VALUES (datetime('now'), ?)",
+		[]interface{}{string(b)})
+	if err != nil {
+		return cp, err
+	}
+
+	res, _, err := tx.Query("SELECT ID, DATETIME FROM __DBCHECKPOINT__ WHERE ID = last_insert_rowid()",
+		[]interface{}{})
+	if err != nil {
+		return cp, err
+	}
+	cp.ID, _ = strconv.ParseInt(*res[0][0].(*string), 10, 64)
+	cp.Datetime, cp.Seqs = *res[0][1].(*string), v.Seqs
+	return cp, nil
+}
+
+//Prune remove from the log the txs before the last checkpoint that all
+//known peers acknowledged. The pruned txs are recorded as applied by
+//origin, and by id while older nodes, that don't keep the origin, are
+//seen, so they are never requested or applied again. Txs without origin
+//are not pruned. It return the number of txs removed
+func (db *SyncDB) Prune() (int, error) {
+	if db.totalOrder {
+		return 0, ErrPruneTotalOrder
+	}
+
+	tx, err := db.beginInternal()
+	if err != nil {
+		return 0, err
+	}
+	total, err := tx.prune()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return total, tx.Commit()
+}
+
+//prune remove the txs acknowledged, it must be in a transaction
+func (tx *Tx) prune() (int, error) {
+	res, _, err := tx.Query("SELECT VECTOR FROM __DBCHECKPOINT__ ORDER BY ID DESC LIMIT 1", []interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, ErrNoCheckpoint
+	}
+	limits := map[string]int64{}
+	err = json.Unmarshal([]byte(*res[0][0].(*string)), &limits)
+	if err != nil {
+		return 0, err
+	}
+
+	//txs never acknowledged are kept
+	peers, _, err := tx.Query("SELECT VECTOR FROM __DBPEER__", []interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	if len(peers) == 0 {
+		return 0, nil
+	}
+	for _, row := range peers {
+		acked := map[string]int64{}
+		err = json.Unmarshal([]byte(*row[0].(*string)), &acked)
+		if err != nil {
+			return 0, err
+		}
+		for origin, limit := range limits {
+			if acked[origin] < limit {
+				limits[origin] = acked[origin]
+			}
+		}
+	}
+
+	pruned, err := tx.prunedMarks()
+	if err != nil {
+		return 0, err
+	}
+
+	//only older nodes send txs by id, without the origin, the ids of the
+	//pruned txs are kept while they are seen
+	res, _, err = tx.Query("SELECT 1 FROM SETTINGS WHERE KEY = 'legacyseen' AND VALUE > datetime('now', ?)",
+		[]interface{}{legacyTTL})
+	if err != nil {
+		return 0, err
+	}
+	legacy := len(res) > 0
+	if !legacy {
+		err = tx.ExecWithoutLog("DELETE FROM __DBPRUNEDTX__", []interface{}{})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	total := 0
+	for origin, limit := range limits {
+		if limit <= pruned[origin] {
+			continue
+		}
+
+		res, _, err := tx.Query("SELECT COUNT(*) FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ <= ?",
+			[]interface{}{origin, limit})
+		if err != nil {
+			return 0, err
+		}
+		n, _ := strconv.Atoi(*res[0][0].(*string))
+		total += n
+
+		if legacy {
+			err = tx.ExecWithoutLog(`INSERT OR IGNORE INTO __DBPRUNEDTX__(ID)
+				SELECT ID FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ <= ?`, []interface{}{origin, limit})
+			if err != nil {
+				return 0, err
+			}
+		}
+		err = tx.ExecWithoutLog(`DELETE FROM __DBLOG__ WHERE TXID IN
+			(SELECT ID FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ <= ?)`, []interface{}{origin, limit})
+		if err != nil {
+			return 0, err
+		}
+		err = tx.ExecWithoutLog("DELETE FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ <= ?",
+			[]interface{}{origin, limit})
+		if err != nil {
+			return 0, err
+		}
+		err = tx.ExecWithoutLog("INSERT OR REPLACE INTO __DBPRUNED__(ORIGIN, OSEQ) VALUES (?, ?)",
+			[]interface{}{origin, limit})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+//legacySeen record the contact with an older node, or with a node with
+//other legacy txs, that can send pruned txs without the origin
+func (db *SyncDB) legacySeen() error {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return err
+	}
+	res, _, err := tx.Query("SELECT 1 FROM SETTINGS WHERE KEY = 'legacyseen' AND VALUE > datetime('now', '-1 day')",
+		[]interface{}{})
+	tx.Commit()
+	if err != nil || len(res) > 0 {
+		return err
+	}
+
+	tx, err = db.beginInternal()
+	if err != nil {
+		return err
+	}
+	err = tx.Set("legacyseen", time.Now().UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//withoutPruned return the uuids of txs not pruned
+func (db *SyncDB) withoutPruned(uuids []string) ([]string, error) {
+	if len(uuids) == 0 {
+		return uuids, nil
+	}
+
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	//the uuids are looked up in chunks, under the limit of parameters of SQLite
+	pruned := map[string]bool{}
+	for start := 0; start < len(uuids); start += 500 {
+		chunk := uuids[start:]
+		if len(chunk) > 500 {
+			chunk = chunk[:500]
+		}
+		args := make([]interface{}, len(chunk))
+		for i, uuid := range chunk {
+			args[i] = uuid
+		}
+		res, _, err := tx.Query("SELECT ID FROM __DBPRUNEDTX__ WHERE ID IN (?"+
+			strings.Repeat(", ?", len(chunk)-1)+")", args)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range res {
+			pruned[*row[0].(*string)] = true
+		}
+	}
+	ret := []string{}
+	for _, uuid := range uuids {
+		if !pruned[uuid] {
+			ret = append(ret, uuid)
+		}
+	}
+	return ret, nil
+}
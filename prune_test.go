@@ -0,0 +1,226 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+
+	_, err := db.Prune()
+	if err != ErrNoCheckpoint {
+		t.Error("Prune without checkpoint", err)
+	}
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+	for i := 1; i <= 2; i++ {
+		tx, _ = db.Begin()
+		tx.Exec("insert into foo values (?, ?)", []interface{}{i, "teste" + strconv.Itoa(i)})
+		tx.Commit()
+	}
+
+	cp, err := db.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.ID == 0 || cp.Seqs[node1] != 3 {
+		t.Error("Wrong checkpoint", cp)
+	}
+
+	tx, _ = db.Begin()
+	tx.Exec("insert into foo values (3, 'teste3')", []interface{}{})
+	tx.Commit()
+
+	//without known peers nothing is pruned
+	n, err := db.Prune()
+	if err != nil || n != 0 {
+		t.Error("Pruned without peers", n, err)
+	}
+
+	//only the txs acknowledged by all peers are pruned, their ids are kept
+	//while older nodes are seen
+	err = db.legacySeen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned := dump(t, db, "select id from __DBTX__ where origin = '"+node1+"' and oseq = 2")
+	db.recordPeer(syncVector{ID: node2, Seqs: map[string]int64{node1: 2}}, "127.0.0.1:1")
+	db.recordPeer(syncVector{ID: "node3", Seqs: map[string]int64{node1: 3}}, "127.0.0.1:2")
+	n, err = db.Prune()
+	if err != nil || n != 2 {
+		t.Error("Wrong number of txs pruned", n, err)
+	}
+	if c := dump(t, db, "select count(*) from __DBTX__ where origin = '"+node1+"'"); c != `[["2"]]` {
+		t.Error("Wrong txs after prune", c)
+	}
+
+	//the vector and the sequence continue after the pruned txs
+	tx, _ = db.Begin()
+	tx.Exec("insert into foo values (4, 'teste4')", []interface{}{})
+	tx.Commit()
+	v, _ := db.localVector()
+	if v.Seqs[node1] != 5 {
+		t.Error("Wrong vector after prune", v.Seqs)
+	}
+
+	//a pruned tx received again is not applied
+	err = db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-pruned", HLC{Wall: 100}, node1, 1,
+		`{"SQL": "insert into foo values (5, 'teste5')"}`)})
+	if err != nil {
+		t.Error(err)
+	}
+	if names := fooNames(t, db); names != "teste1,teste2,teste3,teste4" {
+		t.Error("Pruned tx applied", names)
+	}
+
+	//also when sent by an older node, without origin
+	var ids [][]string
+	json.Unmarshal([]byte(pruned), &ids)
+	err = db.syncRegister(context.Background(), "", []txReg{remoteTx(ids[0][0], HLC{}, "", 0,
+		`{"SQL": "insert into foo values (6, 'teste6')"}`)})
+	if err != nil {
+		t.Error(err)
+	}
+	if names := fooNames(t, db); names != "teste1,teste2,teste3,teste4" {
+		t.Error("Pruned legacy tx applied", names)
+	}
+
+	//the ids are looked up in chunks
+	uuids := []string{ids[0][0]}
+	for i := 0; i < 600; i++ {
+		uuids = append(uuids, "tx-"+strconv.Itoa(i))
+	}
+	uuids, err = db.withoutPruned(uuids)
+	if err != nil || len(uuids) != 600 || uuids[0] != "tx-0" {
+		t.Error("Wrong txs not pruned", len(uuids), err)
+	}
+
+	//a forgotten peer don't hold the prune
+	db.Checkpoint()
+	db.ForgetPeer(node2)
+	n, err = db.Prune()
+	if err != nil || n != 1 {
+		t.Error("Wrong number of txs pruned", n, err)
+	}
+}
+
+func TestPruneSync(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	//the second sync records the vector of db2 with the txs of db1
+	for i := 0; i < 2; i++ {
+		err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db1.Checkpoint()
+	n, err := db1.Prune()
+	if err != nil || n != 1 {
+		t.Error("Wrong number of txs pruned", n, err)
+	}
+
+	//without older nodes the ids of the pruned txs are not kept
+	if c := dump(t, db1, "select count(*) from __DBPRUNEDTX__"); c != `[["0"]]` {
+		t.Error("Pruned ids kept without older nodes", c)
+	}
+
+	tx, _ = db2.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Commit()
+
+	err = db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := fooNames(t, db1); names != "teste1,teste2" {
+		t.Error("Wrong names after sync", names)
+	}
+
+	v1, _ := db1.localVector()
+	v2, _ := db2.localVector()
+	if v1.Seqs[node1] != 1 || v1.Seqs[node2] != 1 || v2.Seqs[node1] != 1 {
+		t.Error("Wrong vectors", v1.Seqs, v2.Seqs)
+	}
+}
+
+func TestPruneTotalOrder(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, TotalOrder: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	_, err = db.Prune()
+	if err != ErrPruneTotalOrder {
+		t.Error("Prune in total order mode", err)
+	}
+}
+
+func TestPruneBootstrapRequired(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (1, 'a')", []interface{}{})
+	tx.Commit()
+	for i := 0; i < 2; i++ {
+		db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	}
+	db1.Checkpoint()
+	n, err := db1.Prune()
+	if err != nil || n != 2 {
+		t.Fatal("Wrong number of txs pruned", n, err)
+	}
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (2, 'b')", []interface{}{})
+	tx.Commit()
+
+	//a new node don't get the txs after the pruned ones, with a gap
+	db3 := newTestNode(t, "node3")
+	defer db3.Close(context.Background())
+	err = db3.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != ErrBootstrapRequired {
+		t.Error("Expected ErrBootstrapRequired", err)
+	}
+	err = db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db3.port))
+	if err != nil {
+		t.Error(err)
+	}
+	if v, _ := db3.localVector(); len(v.Seqs) != 0 {
+		t.Error("Txs after the pruned ones received", v.Seqs)
+	}
+
+	err = db3.BootstrapFrom(net.JoinHostPort("127.0.0.1", strconv.Itoa(db1.port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := fooNames(t, db3); names != "a,b" {
+		t.Error("Wrong names after bootstrap", names)
+	}
+	err = db3.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,199 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+)
+
+var (
+	//ErrTxNotQuarantined is returned for a tx id not in quarantine
+	ErrTxNotQuarantined = errors.New("tx not in quarantine")
+)
+
+//QuarantinedTx is a remote tx that failed to apply in this node. It is
+//retried in each sync, or by RetryQuarantined
+type QuarantinedTx struct {
+	ID         string
+	TxDatetime string
+	Origin     string
+	OSeq       int64
+	HLC        string
+	//SQLs are the entries of the tx
+	SQLs []string
+	//Statement is the entry that failed, empty when the tx failed as a whole
+	Statement string
+	Error     string
+	//Peer is the node the tx was received from
+	Peer      string
+	Attempts  int
+	FirstSeen string
+	LastSeen  string
+
+	tx txReg
+}
+
+//quarantine record the failure of the remote tx, received from peer
+func (db *SyncDB) quarantine(remote txReg, peer string, err error) error {
+	b, errJSON := json.Marshal(remote)
+	if errJSON != nil {
+		return errJSON
+	}
+
+	//rows and changesets are recorded as the entry
+	statement := ""
+	if applyErr, ok := err.(*TxApplyError); ok {
+		statement = applyErr.Statement.SQL
+		if applyErr.Statement.Row != nil || applyErr.Statement.Changeset != nil {
+			entry, _ := json.Marshal(applyErr.Statement)
+			statement = string(entry)
+		}
+	}
+
+	tx, errBegin := db.beginInternal()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Commit()
+
+	res, _, errq := tx.Query("SELECT PEER FROM __DBQUARANTINE__ WHERE ID = ?", []interface{}{remote.ID})
+	if errq != nil {
+		return errq
+	}
+	if len(res) == 0 {
+		return tx.ExecWithoutLog(`INSERT INTO __DBQUARANTINE__(ID, TX, STATEMENT, ERROR, PEER, ATTEMPTS,
+			FIRSTSEEN, LASTSEEN) VALUES (?, ?, ?, ?, ?, 1, datetime('now'), datetime('now'))`,
+			[]interface{}{remote.ID, string(b), statement, err.Error(), peer})
+	}
+
+	if len(peer) == 0 {
+		peer = *res[0][0].(*string)
+	}
+	return tx.ExecWithoutLog(`UPDATE __DBQUARANTINE__ SET TX = ?, STATEMENT = ?, ERROR = ?, PEER = ?,
+		ATTEMPTS = ATTEMPTS + 1, LASTSEEN = datetime('now') WHERE ID = ?`,
+		[]interface{}{string(b), statement, err.Error(), peer, remote.ID})
+}
+
+//unquarantine remove the tx from quarantine
+func (db *SyncDB) unquarantine(id string) error {
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	return tx.ExecWithoutLog("DELETE FROM __DBQUARANTINE__ WHERE ID = ?", []interface{}{id})
+}
+
+//quarantined return the txs in quarantine with the condition, it must be
+//in a transaction
+func (tx *Tx) quarantined(where string, params []interface{}) ([]QuarantinedTx, error) {
+	res, _, err := tx.Query(`SELECT ID, TX, STATEMENT, ERROR, PEER, ATTEMPTS, FIRSTSEEN, LASTSEEN
+		FROM __DBQUARANTINE__ `+where+` ORDER BY FIRSTSEEN, ID`, params)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []QuarantinedTx{}
+	for _, row := range res {
+		q := QuarantinedTx{ID: *row[0].(*string), Statement: *row[2].(*string), Error: *row[3].(*string),
+			Peer: *row[4].(*string), FirstSeen: *row[6].(*string), LastSeen: *row[7].(*string)}
+		q.Attempts, _ = strconv.Atoi(*row[5].(*string))
+
+		err = json.Unmarshal([]byte(*row[1].(*string)), &q.tx)
+		if err != nil {
+			return nil, err
+		}
+		q.TxDatetime, q.Origin, q.OSeq, q.HLC = q.tx.TxDatetime, q.tx.Origin, q.tx.OSeq, q.tx.HLC
+		for _, entry := range q.tx.SQLs {
+			q.SQLs = append(q.SQLs, entry.SQL)
+		}
+		ret = append(ret, q)
+	}
+	return ret, nil
+}
+
+//QuarantinedTxs return the remote txs that failed to apply in this node
+func (db *SyncDB) QuarantinedTxs() ([]QuarantinedTx, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	return tx.quarantined("", []interface{}{})
+}
+
+func (db *SyncDB) quarantinedTx(id string) (QuarantinedTx, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return QuarantinedTx{}, err
+	}
+	defer tx.Commit()
+
+	txs, err := tx.quarantined("WHERE ID = ?", []interface{}{id})
+	if err != nil {
+		return QuarantinedTx{}, err
+	}
+	if len(txs) == 0 {
+		return QuarantinedTx{}, ErrTxNotQuarantined
+	}
+	return txs[0], nil
+}
+
+//RetryQuarantined apply again the tx in quarantine, it leave the
+//quarantine when applied
+func (db *SyncDB) RetryQuarantined(id string) error {
+	q, err := db.quarantinedTx(id)
+	if err != nil {
+		return err
+	}
+
+	return db.applyTxs(context.Background(), []txReg{q.tx}, map[string]string{id: q.Peer},
+		map[string]bool{id: true})
+}
+
+//DiscardQuarantined give up the tx in quarantine: it is recorded as
+//received, without change the database. So it is not requested again and
+//other nodes still receive it from this node
+func (db *SyncDB) DiscardQuarantined(id string) error {
+	q, err := db.quarantinedTx(id)
+	if err != nil {
+		return err
+	}
+
+	err = db.startApply()
+	if err != nil {
+		return err
+	}
+	defer db.applying.Done()
+
+	tx, err := db.beginRemote(context.Background(), q.tx)
+	if err != nil && err != errTxExists {
+		return err
+	}
+	if err == nil {
+		for _, entry := range q.tx.SQLs {
+			idlog, err := uuid.NewV4()
+			if err == nil {
+				_, err = tx.tx.Exec(`INSERT INTO __DBLOG__(id, txid, sql, seq, datetime)
+					VALUES (?, ?, ?, ?, datetime('now'))`, idlog.String(), tx.idtx, entry.SQL, tx.seq)
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			tx.seq++
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.unquarantine(id)
+}
@@ -0,0 +1,102 @@
+package syncdb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	err = db.syncRegister(context.Background(), "10.0.0.2:12345", []txReg{
+		remoteTx("tx-1", HLC{Wall: 100}, node2, 1, `{"SQL": "insert into foo values (1, 'a')"}`),
+		remoteTx("tx-2", HLC{Wall: 200}, node2, 2, `{"SQL": "insert into foo values (2, 'b')"}`)})
+	if _, ok := err.(*TxApplyError); !ok {
+		t.Fatal("Expected TxApplyError", err)
+	}
+
+	txs, err := db.QuarantinedTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 {
+		t.Fatal("Wrong number of quarantined txs", len(txs))
+	}
+	q := txs[0]
+	if q.ID != "tx-1" || q.Origin != node2 || q.OSeq != 1 || q.Peer != "10.0.0.2:12345" || q.Attempts != 1 ||
+		q.Statement != "insert into foo values (1, 'a')" || len(q.Error) == 0 || len(q.SQLs) != 1 {
+		t.Error("Wrong quarantined tx", q)
+	}
+
+	err = db.RetryQuarantined("tx-1")
+	if _, ok := err.(*TxApplyError); !ok {
+		t.Error("Expected TxApplyError", err)
+	}
+	q, err = db.quarantinedTx("tx-1")
+	if err != nil || q.Attempts != 2 || q.Peer != "10.0.0.2:12345" {
+		t.Error("Wrong retried tx", q, err)
+	}
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	err = db.RetryQuarantined("tx-1")
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.RetryQuarantined("tx-1")
+	if err != ErrTxNotQuarantined {
+		t.Error("Expected ErrTxNotQuarantined", err)
+	}
+
+	//a discarded tx is recorded, but not applied
+	err = db.DiscardQuarantined("tx-2")
+	if err != nil {
+		t.Error(err)
+	}
+	if names := fooNames(t, db); names != "a" {
+		t.Error("Wrong names", names)
+	}
+	v, err := db.localVector()
+	if err != nil || v.Seqs[node2] != 2 {
+		t.Error("Discarded tx not recorded", v, err)
+	}
+	txs, err = db.QuarantinedTxs()
+	if err != nil || len(txs) != 0 {
+		t.Error("Txs left in quarantine", txs, err)
+	}
+}
+
+func TestQuarantineNotRetriedByPeers(t *testing.T) {
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+
+	db.syncRegister(context.Background(), "", []txReg{
+		remoteTx("tx-1", HLC{Wall: 100}, node2, 1, `{"SQL": "insert into foo values (1, 'a')"}`)})
+
+	//the txs sent by a peer don't retry the quarantine
+	res, err := http.Post("http://127.0.0.1:"+strconv.Itoa(db.port)+"/diffs", "application/json",
+		strings.NewReader(`{"IHas": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	q, err := db.quarantinedTx("tx-1")
+	if err != nil || q.Attempts != 1 {
+		t.Error("Quarantine retried by a peer", q.Attempts, err)
+	}
+
+	db.syncRegister(context.Background(), "", nil)
+	q, err = db.quarantinedTx("tx-1")
+	if err != nil || q.Attempts != 2 {
+		t.Error("Quarantine not retried by the sync", q.Attempts, err)
+	}
+}
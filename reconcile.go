@@ -0,0 +1,314 @@
+package syncdb
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	//reconcileLeaf is the size of buckets listed by id, instead of split
+	reconcileLeaf = 16
+)
+
+var (
+	//ErrReconcileNotSupported is returned by nodes without /buckets
+	ErrReconcileNotSupported = errors.New("node don't support reconciliation")
+)
+
+//bucket summarize the tx ids with a prefix
+type bucket struct {
+	Count int
+	Hash  string
+}
+
+//prefixEnd return the first string after all the strings starting with
+//prefix, empty when there is none
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+//prefixedUUIDs return the local tx ids starting with one of prefixes, in
+//order. Each prefix is a range of the ID index
+func (db *SyncDB) prefixedUUIDs(prefixes []string, legacy bool) ([]string, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	sorted := append([]string{}, prefixes...)
+	sort.Strings(sorted)
+
+	ret := []string{}
+	for _, p := range sorted {
+		conds := []string{}
+		params := []interface{}{}
+		if len(p) > 0 {
+			conds = append(conds, "ID >= ?")
+			params = append(params, p)
+		}
+		if end := prefixEnd(p); len(end) > 0 {
+			conds = append(conds, "ID < ?")
+			params = append(params, end)
+		}
+		if legacy {
+			conds = append(conds, "ORIGIN IS NULL")
+		}
+
+		where := ""
+		if len(conds) > 0 {
+			where = "WHERE " + strings.Join(conds, " AND ") + " "
+		}
+		res, _, err := tx.Query("SELECT ID FROM __DBTX__ "+where+"ORDER BY ID", params)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range res {
+			ret = append(ret, *val[0].(*string))
+		}
+	}
+	return ret, nil
+}
+
+//withPrefixes return the ids of sorted starting with one of prefixes
+func withPrefixes(sorted []string, prefixes []string) []string {
+	ret := []string{}
+	for _, p := range prefixes {
+		for i := sort.SearchStrings(sorted, p); i < len(sorted) && strings.HasPrefix(sorted[i], p); i++ {
+			ret = append(ret, sorted[i])
+		}
+	}
+	return ret
+}
+
+//buckets split the ids starting with prefixes by the next character. A
+//size of -1 give the root, one bucket with all the ids
+func buckets(uuids []string, size int) map[string]bucket {
+	groups := map[string][]string{}
+	for _, id := range uuids {
+		key := id
+		if len(id) > size {
+			key = id[:size+1]
+		}
+		groups[key] = append(groups[key], id)
+	}
+
+	ret := map[string]bucket{}
+	for key, ids := range groups {
+		sort.Strings(ids)
+		h := sha1.New()
+		for _, id := range ids {
+			h.Write([]byte(id))
+			h.Write([]byte{0})
+		}
+		ret[key] = bucket{Count: len(ids), Hash: hex.EncodeToString(h.Sum(nil))}
+	}
+	return ret
+}
+
+func handleBuckets(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value(keyDB).(*SyncDB)
+
+	//without prefixes it is the root, with the first level of buckets
+	//of the same scan
+	prefixes := r.URL.Query()["p"]
+	root := len(prefixes) == 0
+	if root {
+		prefixes = []string{""}
+	}
+
+	//404 is for nodes without the endpoint
+	uuids, err := db.prefixedUUIDs(prefixes, r.URL.Query().Get("legacy") == "1")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ret := buckets(uuids, len(prefixes[0]))
+	if root {
+		for key, b := range buckets(uuids, -1) {
+			ret[key] = b
+		}
+	}
+	b, err := json.Marshal(ret)
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func prefixQuery(prefixes []string, legacy bool) string {
+	q := url.Values{}
+	for _, p := range prefixes {
+		q.Add("p", p)
+	}
+	if legacy {
+		q.Set("legacy", "1")
+	}
+	return q.Encode()
+}
+
+func getBucketsFromNode(ctx context.Context, ip, port string, prefixes []string,
+	legacy bool) (map[string]bucket, error) {
+	res, err := httpGet(ctx, "http://"+ip+":"+port+"/buckets?"+prefixQuery(prefixes, legacy))
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, ErrReconcileNotSupported)
+	}
+
+	ret := map[string]bucket{}
+	err = json.Unmarshal(text, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//reconcileWithNode find the txs only the node has and the txs only
+//this db has, comparing the hashes of buckets of ids level by level and
+//listing only the ids of small buckets that differ. The first level is
+//only the hash of all the ids, equal nodes stop there. The local ids are
+//read once, the node send the root with its first level
+func (db *SyncDB) reconcileWithNode(ctx context.Context, ip, port string,
+	legacy bool) (onlyRemote, onlyLocal []string, err error) {
+	rroot, err := getBucketsFromNode(ctx, ip, port, nil, legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := db.prefixedUUIDs([]string{""}, legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefixes := []string{}
+	leaves := []string{}
+	r, l := rroot[""], buckets(all, -1)[""]
+	switch {
+	case r.Hash == l.Hash:
+		return nil, nil, nil
+	case r.Count+l.Count <= reconcileLeaf:
+		leaves = append(leaves, "")
+	default:
+		prefixes = append(prefixes, "")
+	}
+
+	//nodes sending only the root are asked the first level
+	delete(rroot, "")
+	for len(prefixes) > 0 {
+		rbuckets := rroot
+		if len(prefixes) > 1 || len(prefixes[0]) > 0 || len(rroot) == 0 {
+			rbuckets, err = getBucketsFromNode(ctx, ip, port, prefixes, legacy)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		lbuckets := buckets(withPrefixes(all, prefixes), len(prefixes[0]))
+
+		keys := map[string]bool{}
+		for key := range rbuckets {
+			keys[key] = true
+		}
+		for key := range lbuckets {
+			keys[key] = true
+		}
+
+		next := []string{}
+		for key := range keys {
+			r, l := rbuckets[key], lbuckets[key]
+			switch {
+			case r.Hash == l.Hash:
+			case r.Count+l.Count <= reconcileLeaf || len(key) == len(prefixes[0]):
+				leaves = append(leaves, key)
+			default:
+				next = append(next, key)
+			}
+		}
+		prefixes = next
+	}
+
+	if len(leaves) == 0 {
+		return nil, nil, nil
+	}
+
+	//leaves can have different sizes, list them by size
+	bySize := map[int][]string{}
+	for _, leaf := range leaves {
+		bySize[len(leaf)] = append(bySize[len(leaf)], leaf)
+	}
+
+	rset, lset := map[string]bool{}, map[string]bool{}
+	for _, group := range bySize {
+		ruuids, err := getPrefixedUUIDSFromNode(ctx, ip, port, group, legacy)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range ruuids {
+			rset[id] = true
+		}
+		for _, id := range withPrefixes(all, group) {
+			lset[id] = true
+		}
+	}
+
+	for id := range rset {
+		if !lset[id] {
+			onlyRemote = append(onlyRemote, id)
+		}
+	}
+	for id := range lset {
+		if !rset[id] {
+			onlyLocal = append(onlyLocal, id)
+		}
+	}
+	return onlyRemote, onlyLocal, nil
+}
+
+func getPrefixedUUIDSFromNode(ctx context.Context, ip, port string, prefixes []string,
+	legacy bool) ([]string, error) {
+	res, err := httpGet(ctx, "http://"+ip+":"+port+"/txs?"+prefixQuery(prefixes, legacy))
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := []string{}
+	err = json.Unmarshal(text, &uuids)
+	if err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
@@ -0,0 +1,121 @@
+package syncdb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+func insertLegacyTx(t *testing.T, db *SyncDB, id string) {
+	_, err := db.sqlite.Exec("INSERT INTO __DBTX__(ID, DATETIME) VALUES (?, datetime('now'))", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	b := buckets([]string{"ab1", "ab2", "ac1", "b"}, 1)
+	if len(b) != 3 || b["ab"].Count != 2 || b["ac"].Count != 1 || b["b"].Count != 1 {
+		t.Error("Wrong buckets", b)
+	}
+
+	b2 := buckets([]string{"ab2", "ab1"}, 1)
+	if b2["ab"].Hash != b["ab"].Hash {
+		t.Error("Hash depends on order")
+	}
+
+	root := buckets([]string{"ab1", "ab2", "ac1", "b"}, -1)
+	if len(root) != 1 || root[""].Count != 4 {
+		t.Error("Wrong root bucket", root)
+	}
+
+	ids := withPrefixes([]string{"ab1", "ab2", "ac1", "b"}, []string{"ab", "b"})
+	if strings.Join(ids, ",") != "ab1,ab2,b" {
+		t.Error("Wrong ids of prefixes", ids)
+	}
+}
+
+func TestPrefixedUUIDs(t *testing.T) {
+	if prefixEnd("ab") != "ac" || prefixEnd("a\xff") != "b" || prefixEnd("") != "" {
+		t.Error("Wrong prefix end")
+	}
+
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+	for _, id := range []string{"a0", "a1", "ab", "b0", "b1", "c0"} {
+		insertLegacyTx(t, db, id)
+	}
+
+	uuids, err := db.prefixedUUIDs([]string{"b", "a"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(uuids, ",") != "a0,a1,ab,b0,b1" {
+		t.Error("Wrong uuids", uuids)
+	}
+
+	//the prefixes are ranges of the index, not a scan
+	plan := dump(t, db, "explain query plan select ID from __DBTX__ where ID >= 'a' and ID < 'b' order by ID")
+	if !strings.Contains(plan, "SEARCH") {
+		t.Error("Prefix not searched by index", plan)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	for i := 0; i < 500; i++ {
+		id, _ := uuid.NewV4()
+		insertLegacyTx(t, db1, id.String())
+		insertLegacyTx(t, db2, id.String())
+	}
+
+	only1 := []string{}
+	for i := 0; i < 3; i++ {
+		id, _ := uuid.NewV4()
+		insertLegacyTx(t, db1, id.String())
+		only1 = append(only1, id.String())
+	}
+	id, _ := uuid.NewV4()
+	insertLegacyTx(t, db2, id.String())
+	only2 := []string{id.String()}
+
+	onlyRemote, onlyLocal, err := db1.reconcileWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(only1)
+	sort.Strings(onlyLocal)
+	if len(onlyLocal) != 3 || onlyLocal[0] != only1[0] || onlyLocal[2] != only1[2] {
+		t.Error("Wrong only local", onlyLocal, only1)
+	}
+	if len(onlyRemote) != 1 || onlyRemote[0] != only2[0] {
+		t.Error("Wrong only remote", onlyRemote, only2)
+	}
+
+	//the root come with the first level, of the same scan
+	root, err := getBucketsFromNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root[""].Count != 501 || len(root) != 17 || root["0"].Count+root["f"].Count == 0 {
+		t.Error("Wrong root", len(root), root[""])
+	}
+
+	//equal sets
+	onlyRemote, onlyLocal, err = db1.reconcileWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onlyRemote) != 0 || len(onlyLocal) != 0 {
+		t.Error("Unexpected differences", onlyRemote, onlyLocal)
+	}
+}
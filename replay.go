@@ -0,0 +1,118 @@
+package syncdb
+
+import (
+	"encoding/json"
+	"log"
+)
+
+//txOrderKey is the position of the tx in the global order of txs: by
+//hybrid logical clock, datetime (for legacy txs) and id
+func txOrderKey(hlc, datetime, id string) string {
+	return hlc + "\x00" + datetime + "\x00" + id
+}
+
+//lastTxKey return the order key of the last tx applied
+func (db *SyncDB) lastTxKey() (string, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Commit()
+
+	res, _, err := tx.Query(`SELECT IFNULL(HLC, ''), IFNULL(DATETIME, ''), ID FROM __DBTX__
+		ORDER BY HLC DESC, DATETIME DESC, ID DESC LIMIT 1`, []interface{}{})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", nil
+	}
+	return txOrderKey(*res[0][0].(*string), *res[0][1].(*string), *res[0][2].(*string)), nil
+}
+
+//userObjects return the tables and views of the application, they are
+//the state rebuilt by replay. Log and settings tables are kept
+func (tx *Tx) userObjects() ([][]interface{}, error) {
+	res, _, err := tx.Query(`SELECT type, name FROM sqlite_master
+		WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite!_%' ESCAPE '!'
+		AND name NOT LIKE '!_!_%!_!_' ESCAPE '!' AND UPPER(name) <> 'SETTINGS'
+		ORDER BY CASE type WHEN 'view' THEN 0 ELSE 1 END`, []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//Rebuild drop the tables of the application and replay all logged txs in
+//the global order, the same in all nodes. After it, nodes with the same
+//txs have the same contents, whatever the order they received the txs
+func (db *SyncDB) Rebuild() error {
+	if db.Debug {
+		log.Println("REBUILD", strace())
+	}
+
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx.tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	objs, err := tx.userObjects()
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		err = tx.ExecWithoutLog("DROP "+*obj[0].(*string)+" \""+*obj[1].(*string)+"\"", []interface{}{})
+		if err != nil {
+			return err
+		}
+	}
+
+	res, _, err := tx.Query(`SELECT L.SQL, T.ID FROM __DBTX__ T JOIN __DBLOG__ L ON L.TXID = T.ID
+		ORDER BY T.HLC, T.DATETIME, T.ID, L.SEQ`, []interface{}{})
+	if err != nil {
+		return err
+	}
+
+	for _, row := range res {
+		sql := SQLreg{}
+		err = json.Unmarshal([]byte(*row[0].(*string)), &sql)
+		if err != nil {
+			return err
+		}
+
+		//the same statements fail in all nodes
+		err = tx.applyReg(sql, false)
+		if err != nil {
+			log.Println("ERROR in rebuild", sql.SQL, sql.Params, *row[1].(*string), err)
+		}
+	}
+
+	//the txs writing the rows are not known after replay
+	err = tx.ExecWithoutLog("DELETE FROM __DBROWVER__", []interface{}{})
+	if err != nil {
+		return err
+	}
+	err = tx.createVersionTriggers()
+	if err != nil {
+		return err
+	}
+
+	//tables recreated by replay need capture triggers
+	if db.logMode == LogRows {
+		err = tx.clearChanges()
+		if err != nil {
+			return err
+		}
+		err = tx.createCaptureTriggers()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
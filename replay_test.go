@@ -0,0 +1,98 @@
+package syncdb
+
+import (
+	"context"
+	"testing"
+)
+
+func remoteTx(id string, hlc HLC, origin string, oseq int64, sqls ...string) txReg {
+	tx := txReg{ID: id, TxDatetime: "2018-11-20 10:00:00", HLC: hlc.String(),
+		Origin: origin, OSeq: oseq}
+	for _, sql := range sqls {
+		tx.SQLs = append(tx.SQLs, logReg{SQL: sql})
+	}
+	return tx
+}
+
+func fooNames(t *testing.T, db *SyncDB) string {
+	tx, _ := db.BeginForQuery()
+	defer tx.Commit()
+
+	rows, _, err := tx.Query("select group_concat(name, ',') from (select name from foo order by id)", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *rows[0][0].(*string)
+}
+
+func TestTotalOrderReplay(t *testing.T) {
+	create := remoteTx("tx-create", HLC{Wall: 100}, node1, 1,
+		`{"SQL": "create table foo(id integer not null primary key, name text)"}`)
+	tx1 := remoteTx("tx-1", HLC{Wall: 200}, node1, 2,
+		`{"SQL": "insert or replace into foo values (1, 'a')"}`,
+		`{"SQL": "insert into foo values (NULL, 'x')"}`)
+	tx2 := remoteTx("tx-2", HLC{Wall: 300}, node2, 1,
+		`{"SQL": "insert or replace into foo values (1, 'b')"}`,
+		`{"SQL": "insert into foo values (NULL, 'y')"}`)
+
+	results := map[bool][]string{}
+	for _, totalOrder := range []bool{false, true} {
+		dbA, err := NewWithOptions(":memory:", Options{DisableServer: true, TotalOrder: totalOrder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbA.Close(context.Background())
+		dbB, err := NewWithOptions(":memory:", Options{DisableServer: true, TotalOrder: totalOrder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbB.Close(context.Background())
+
+		dbA.syncRegister(context.Background(), "", []txReg{create, tx1})
+		dbA.syncRegister(context.Background(), "", []txReg{tx2})
+
+		dbB.syncRegister(context.Background(), "", []txReg{create, tx2})
+		dbB.syncRegister(context.Background(), "", []txReg{tx1})
+
+		results[totalOrder] = []string{fooNames(t, dbA), fooNames(t, dbB)}
+	}
+
+	if results[false][0] == results[false][1] {
+		t.Error("Expected divergence without total order", results[false])
+	}
+
+	if results[true][0] != results[true][1] || results[true][0] != "b,x,y" {
+		t.Error("Nodes don't converge in total order", results[true])
+	}
+}
+
+func TestRebuildKeepsSettings(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true, TotalOrder: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Set("company", idcompany)
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("create view vfoo as select name from foo", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	err = db.Rebuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fooNames(t, db) != "teste1" {
+		t.Error("Wrong contents after rebuild", fooNames(t, db))
+	}
+
+	tx, _ = db.BeginForQuery()
+	company, err := tx.Get("company")
+	tx.Commit()
+	if err != nil || company != idcompany {
+		t.Error("Settings lost in rebuild", company, err)
+	}
+}
@@ -0,0 +1,525 @@
+package syncdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//LogMode is how the changes of txs are recorded in __DBLOG__ and shipped
+//to other nodes
+type LogMode int
+
+const (
+	//LogSQL record the sql statements and its params, peers execute them again
+	LogSQL LogMode = iota
+	//LogRows record the rows changed by each statement (table, key, values
+	//before and after), captured by triggers, and peers apply the same
+	//changes. Schema statements (CREATE, ALTER, DROP) are still recorded
+	//as sql
+	LogRows
+	//LogChangeset record the changes of each tx as a changeset of the
+	//SQLite session extension, applied by peers with sqlite3changeset_apply.
+	//Schema statements are recorded as sql, between changesets. It needs
+	//the sqlite_session build tag, see changeset.go
+	LogChangeset
+)
+
+const (
+	captureTriggerPrefix = "__dbchg_"
+)
+
+var (
+	//ErrRowNotFound is returned applying an update to a row that not exists
+	ErrRowNotFound = errors.New("Row to change not found")
+
+	//ErrChangesetNotSupported is returned for LogChangeset when built
+	//without the sqlite_session tag
+	ErrChangesetNotSupported = errors.New("LogChangeset needs the sqlite_session build tag")
+
+	//ErrNoPrimaryKey is returned in LogChangeset mode for tables without
+	//PRIMARY KEY, the session extension don't record their changes
+	ErrNoPrimaryKey = errors.New("LogChangeset needs a PRIMARY KEY in all tables")
+
+	//ErrRowChanged is the conflict of a changeset changing a row that has
+	//other values in this node, and ErrRowExists of inserting a key that
+	//exists
+	ErrRowChanged = errors.New("Row to change has other values")
+	ErrRowExists  = errors.New("Row to insert exists")
+)
+
+//RowValues are the values of a row. Blobs and floats are kept with their
+//types when encoded as json
+type RowValues []interface{}
+
+//MarshalJSON encode blobs as {"b": base64} and floats as {"f": number}
+func (v RowValues) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, len(v))
+	for i, val := range v {
+		switch x := val.(type) {
+		case []byte:
+			out[i] = map[string]string{"b": base64.StdEncoding.EncodeToString(x)}
+		case float64:
+			out[i] = map[string]float64{"f": x}
+		default:
+			out[i] = x
+		}
+	}
+	return json.Marshal(out)
+}
+
+//UnmarshalJSON decode the values encoded by MarshalJSON
+func (v *RowValues) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	in := []interface{}{}
+	err := dec.Decode(&in)
+	if err != nil {
+		return err
+	}
+
+	out := make(RowValues, len(in))
+	for i, val := range in {
+		switch x := val.(type) {
+		case json.Number:
+			n, err := x.Int64()
+			if err != nil {
+				f, err := x.Float64()
+				if err != nil {
+					return err
+				}
+				out[i] = f
+				continue
+			}
+			out[i] = n
+		case map[string]interface{}:
+			if s, ok := x["b"].(string); ok {
+				blob, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return err
+				}
+				out[i] = blob
+			} else if f, ok := x["f"].(json.Number); ok {
+				out[i], err = f.Float64()
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			out[i] = x
+		}
+	}
+	*v = out
+	return nil
+}
+
+//RowChange is the change of one row, recorded in LogRows mode
+type RowChange struct {
+	Table string
+	//Op is INSERT, UPDATE or DELETE
+	Op string
+	//Cols are the columns of the table, with rowid for tables without
+	//INTEGER PRIMARY KEY
+	Cols []string
+	//Key are the columns identifying the row, the primary key or rowid
+	Key []string
+	//Old are the values before UPDATE and DELETE, in order of Cols
+	Old RowValues `json:",omitempty"`
+	//New are the values after INSERT and UPDATE, in order of Cols
+	New RowValues `json:",omitempty"`
+}
+
+//tableInfo describe a table for row capture
+type tableInfo struct {
+	cols  []string
+	key   []string
+	rowid bool
+	//alias is the INTEGER PRIMARY KEY column, an alias of rowid
+	alias string
+}
+
+func quoteIdent(name string) string {
+	if name == "rowid" {
+		return name
+	}
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+//isSchemaSQL report if the statement change the schema
+func isSchemaSQL(sql string) bool {
+	upsql := strings.ToUpper(strings.TrimSpace(sql))
+	return strings.HasPrefix(upsql, "CREATE") || strings.HasPrefix(upsql, "ALTER") ||
+		strings.HasPrefix(upsql, "DROP")
+}
+
+//userTables return the tables of the application
+func (tx *Tx) userTables() ([]string, error) {
+	objs, err := tx.userObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []string{}
+	for _, obj := range objs {
+		if *obj[0].(*string) == "table" {
+			tables = append(tables, *obj[1].(*string))
+		}
+	}
+	return tables, nil
+}
+
+//tableInfo read the columns and key of table, it must be in a transaction
+func (tx *Tx) tableInfo(table string) (tableInfo, error) {
+	info := tableInfo{}
+
+	res, _, err := tx.Query("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE",
+		[]interface{}{table})
+	if err != nil {
+		return info, err
+	}
+	info.rowid = len(res) == 1 && !strings.Contains(strings.ToUpper(*res[0][0].(*string)), "WITHOUT ROWID")
+
+	rows, _, err := tx.Query("SELECT name, type, pk FROM pragma_table_info(?) ORDER BY cid",
+		[]interface{}{table})
+	if err != nil {
+		return info, err
+	}
+
+	pks := map[string]string{}
+	alias := false
+	for _, row := range rows {
+		name, ctype, pk := *row[0].(*string), *row[1].(*string), *row[2].(*string)
+		info.cols = append(info.cols, name)
+		if pk != "0" {
+			pks[pk] = name
+			if strings.EqualFold(ctype, "INTEGER") {
+				alias = true
+			}
+		}
+	}
+	if len(pks) != 1 {
+		alias = false
+	}
+	if info.rowid && alias {
+		info.alias = pks["1"]
+	}
+
+	for i := 1; i <= len(pks); i++ {
+		info.key = append(info.key, pks[strconv.Itoa(i)])
+	}
+
+	if info.rowid && !alias {
+		info.cols = append(info.cols, "rowid")
+		if len(info.key) == 0 {
+			info.key = []string{"rowid"}
+		}
+	}
+
+	return info, nil
+}
+
+//captureTriggerSQL return the triggers recording the changes of table
+//into __DBCHG__ and __DBCHGVAL__
+func captureTriggerSQL(table string, info tableInfo) []string {
+	name := func(op string) string {
+		return quoteIdent(captureTriggerPrefix + table + "_" + op)
+	}
+	rid := func(img string) string {
+		if info.rowid {
+			return img + ".rowid"
+		}
+		return "NULL"
+	}
+	values := func(img, tag string) string {
+		sels := []string{}
+		for _, col := range info.cols {
+			if col == "rowid" {
+				continue
+			}
+			val := img + "." + quoteIdent(col)
+			sels = append(sels, "SELECT MAX(ID), '"+tag+"', "+quoteLiteral(col)+", typeof("+val+"), "+
+				val+" FROM __DBCHG__")
+		}
+		return "INSERT INTO __DBCHGVAL__(CHG, IMG, COL, TYP, VAL) " + strings.Join(sels, " UNION ALL ") + ";"
+	}
+	t := quoteIdent(table)
+	lt := quoteLiteral(table)
+
+	return []string{
+		"CREATE TRIGGER " + name("i") + " AFTER INSERT ON " + t + " BEGIN " +
+			"INSERT INTO __DBCHG__(TBL, OP, NEWRID) VALUES (" + lt + ", 'INSERT', " + rid("NEW") + "); " +
+			values("NEW", "N") + " END",
+		"CREATE TRIGGER " + name("u") + " AFTER UPDATE ON " + t + " BEGIN " +
+			"INSERT INTO __DBCHG__(TBL, OP, OLDRID, NEWRID) VALUES (" + lt + ", 'UPDATE', " +
+			rid("OLD") + ", " + rid("NEW") + "); " +
+			values("OLD", "O") + " " + values("NEW", "N") + " END",
+		"CREATE TRIGGER " + name("d") + " AFTER DELETE ON " + t + " BEGIN " +
+			"INSERT INTO __DBCHG__(TBL, OP, OLDRID) VALUES (" + lt + ", 'DELETE', " + rid("OLD") + "); " +
+			values("OLD", "O") + " END",
+	}
+}
+
+//dropCaptureTriggers remove the row capture triggers, it must be in a transaction
+func (tx *Tx) dropCaptureTriggers() error {
+	return tx.dropTriggers(captureTriggerPrefix)
+}
+
+//dropTriggers remove the triggers with names starting by prefix, it must
+//be in a transaction
+func (tx *Tx) dropTriggers(prefix string) error {
+	res, _, err := tx.Query("SELECT name FROM sqlite_master WHERE type = 'trigger' AND name LIKE ? ESCAPE '!'",
+		[]interface{}{strings.Replace(prefix, "_", "!_", -1) + "%"})
+	if err != nil {
+		return err
+	}
+
+	for _, row := range res {
+		err = tx.ExecWithoutLog("DROP TRIGGER IF EXISTS "+quoteIdent(*row[0].(*string)), []interface{}{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//createCaptureTriggers (re)create the row capture triggers of all tables,
+//it must be in a transaction
+func (tx *Tx) createCaptureTriggers() error {
+	err := tx.dropCaptureTriggers()
+	if err != nil {
+		return err
+	}
+
+	tables, err := tx.userTables()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		info, err := tx.tableInfo(table)
+		if err != nil {
+			return err
+		}
+		for _, sql := range captureTriggerSQL(table, info) {
+			err = tx.ExecWithoutLog(sql, []interface{}{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//configureCapture create or drop the capture triggers as the log mode
+func (db *SyncDB) configureCapture() error {
+	tx, err := db.beginInternal()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
+
+	return tx.configureCapture()
+}
+
+//configureCapture is configureCapture in the transaction
+func (tx *Tx) configureCapture() error {
+	if tx.db.logMode == LogRows {
+		return tx.createCaptureTriggers()
+	}
+	err := tx.dropCaptureTriggers()
+	if err != nil {
+		return err
+	}
+
+	if tx.db.logMode == LogChangeset {
+		return tx.checkKeys()
+	}
+	return nil
+}
+
+//checkKeys return ErrNoPrimaryKey if some table has no PRIMARY KEY, it
+//must be in a transaction
+func (tx *Tx) checkKeys() error {
+	tables, err := tx.userTables()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		info, err := tx.tableInfo(table)
+		if err != nil {
+			return err
+		}
+		if len(info.key) == 0 || info.key[0] == "rowid" {
+			return ErrNoPrimaryKey
+		}
+	}
+	return nil
+}
+
+//clearChanges discard the captured changes, it must be in a transaction
+func (tx *Tx) clearChanges() error {
+	err := tx.ExecWithoutLog("DELETE FROM __DBCHGVAL__", []interface{}{})
+	if err != nil {
+		return err
+	}
+	return tx.ExecWithoutLog("DELETE FROM __DBCHG__", []interface{}{})
+}
+
+//captureChanges read and discard the changes captured by the triggers,
+//it must be in a transaction
+func (tx *Tx) captureChanges() ([]RowChange, error) {
+	rows, err := tx.tx.Query(`SELECT C.ID, C.TBL, C.OP, C.OLDRID, C.NEWRID, V.IMG, V.COL, V.TYP, V.VAL
+		FROM __DBCHG__ C LEFT JOIN __DBCHGVAL__ V ON V.CHG = C.ID ORDER BY C.ID, V.ROWID`)
+	if err != nil {
+		return nil, err
+	}
+
+	type captured struct {
+		table, op      string
+		oldrid, newrid interface{}
+		old, new       map[string]interface{}
+	}
+	changes := []*captured{}
+	var last int64
+	for rows.Next() {
+		var id int64
+		var table, op string
+		var oldrid, newrid, img, col, typ, val interface{}
+		err = rows.Scan(&id, &table, &op, &oldrid, &newrid, &img, &col, &typ, &val)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(changes) == 0 || id != last {
+			changes = append(changes, &captured{table: table, op: op, oldrid: oldrid, newrid: newrid,
+				old: map[string]interface{}{}, new: map[string]interface{}{}})
+			last = id
+		}
+		c := changes[len(changes)-1]
+		//the driver return text as []byte
+		if asString(typ) == "text" {
+			val = asString(val)
+		}
+		name := asString(col)
+		if asString(img) == "O" {
+			c.old[name] = val
+		} else if asString(img) == "N" {
+			c.new[name] = val
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := []RowChange{}
+	infos := map[string]tableInfo{}
+	for _, c := range changes {
+		info, ok := infos[c.table]
+		if !ok {
+			info, err = tx.tableInfo(c.table)
+			if err != nil {
+				return nil, err
+			}
+			infos[c.table] = info
+		}
+		c.old["rowid"], c.new["rowid"] = c.oldrid, c.newrid
+
+		change := RowChange{Table: c.table, Op: c.op, Cols: info.cols, Key: info.key}
+		for _, col := range info.cols {
+			if c.op != "INSERT" {
+				change.Old = append(change.Old, c.old[col])
+			}
+			if c.op != "DELETE" {
+				change.New = append(change.New, c.new[col])
+			}
+		}
+		ret = append(ret, change)
+	}
+
+	return ret, tx.clearChanges()
+}
+
+func asString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	}
+	return ""
+}
+
+//keyWhere return the condition selecting the row by key, with params
+func (c RowChange) keyWhere(values RowValues) (string, []interface{}) {
+	conds := []string{}
+	params := []interface{}{}
+	for _, key := range c.Key {
+		for i, col := range c.Cols {
+			if col == key {
+				conds = append(conds, quoteIdent(col)+" IS ?")
+				params = append(params, values[i])
+			}
+		}
+	}
+	return strings.Join(conds, " AND "), params
+}
+
+//sql return the statement that apply the change
+func (c RowChange) sql() (string, []interface{}) {
+	t := quoteIdent(c.Table)
+	switch c.Op {
+	case "INSERT":
+		cols, marks := []string{}, []string{}
+		for _, col := range c.Cols {
+			cols = append(cols, quoteIdent(col))
+			marks = append(marks, "?")
+		}
+		return "INSERT INTO " + t + "(" + strings.Join(cols, ", ") + ") VALUES (" +
+			strings.Join(marks, ", ") + ")", []interface{}(c.New)
+
+	case "UPDATE":
+		sets := []string{}
+		for _, col := range c.Cols {
+			sets = append(sets, quoteIdent(col)+" = ?")
+		}
+		where, params := c.keyWhere(c.Old)
+		return "UPDATE " + t + " SET " + strings.Join(sets, ", ") + " WHERE " + where,
+			append(append([]interface{}{}, c.New...), params...)
+
+	default:
+		where, params := c.keyWhere(c.Old)
+		return "DELETE FROM " + t + " WHERE " + where, params
+	}
+}
+
+//execRow apply the row change received from other node, without capture
+//it again, it must be in a transaction
+func (tx *Tx) execRow(c RowChange) error {
+	sql, params := c.sql()
+	res, err := tx.tx.Exec(sql, params...)
+	if err != nil {
+		return err
+	}
+
+	if c.Op == "UPDATE" {
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrRowNotFound
+		}
+	}
+
+	if tx.db.logMode == LogRows {
+		return tx.clearChanges()
+	}
+	return nil
+}
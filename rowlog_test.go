@@ -0,0 +1,175 @@
+package syncdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestRowValuesJSON(t *testing.T) {
+	v := RowValues{int64(9007199254740993), 3.0, []byte{0, 1, 2}, nil, "teste"}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := RowValues{}
+	err = json.Unmarshal(b, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out[0] != int64(9007199254740993) || out[1] != 3.0 || !bytes.Equal(out[2].([]byte), []byte{0, 1, 2}) ||
+		out[3] != nil || out[4] != "teste" {
+		t.Error("Wrong values", out)
+	}
+}
+
+func dump(t *testing.T, db *SyncDB, sql string) string {
+	tx, _ := db.BeginForQuery()
+	defer tx.Commit()
+
+	rows, _, err := tx.Query(sql, []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(rows)
+	return string(b)
+}
+
+func TestLogRows(t *testing.T) {
+	nodes := []*SyncDB{}
+	for _, id := range []string{node1, node2} {
+		db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0", LogMode: LogRows})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(context.Background())
+		tx, _ := db.Begin()
+		tx.Set("id", id)
+		tx.Commit()
+		nodes = append(nodes, db)
+	}
+	db1, db2 := nodes[0], nodes[1]
+
+	tx, _ := db1.Begin()
+	err := tx.Exec("create table foo(id integer primary key, name text, score real, data blob)", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec("create table bar(code text primary key, n integer)", []interface{}{})
+	tx.Exec("create table baz(n integer)", []interface{}{})
+	tx.Commit()
+
+	//values chosen by the local node must arrive on the peer
+	tx, _ = db1.Begin()
+	for i := 0; i < 5; i++ {
+		err = tx.Exec("insert into foo values (NULL, ?, random(), randomblob(4))", []interface{}{"teste" + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Exec("insert into bar values ('a', random()), ('b', random())", []interface{}{})
+	tx.Exec("insert into baz values (random())", []interface{}{})
+	tx.Exec("insert into baz values (random())", []interface{}{})
+	tx.Commit()
+
+	tx, _ = db1.Begin()
+	tx.Exec("update foo set score = random() where id > 2", []interface{}{})
+	tx.Exec("delete from foo where id = 1", []interface{}{})
+	tx.Exec("update bar set code = 'c' where code = 'a'", []interface{}{})
+	tx.Exec("delete from baz where rowid = 1", []interface{}{})
+	tx.Commit()
+
+	err = db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sql := range []string{"select *, typeof(name), typeof(score), typeof(data) from foo order by id",
+		"select *, typeof(n) from bar order by code",
+		"select rowid, * from baz order by rowid"} {
+		d1, d2 := dump(t, db1, sql), dump(t, db2, sql)
+		if d1 != d2 {
+			t.Error("Different contents", sql, d1, d2)
+		}
+	}
+
+	//the log has rows, not the sql
+	remote, _ := db1.uuid2txReg(dump(t, db1, "select id from __DBTX__ where oseq = 3")[3:39])
+	if len(remote.SQLs) != 6 {
+		t.Error("Wrong number of row changes", len(remote.SQLs))
+	}
+	for _, entry := range remote.SQLs {
+		reg := SQLreg{}
+		json.Unmarshal([]byte(entry.SQL), &reg)
+		if reg.Row == nil || len(reg.SQL) > 0 {
+			t.Error("Entry is not a row change", entry.SQL)
+		}
+	}
+
+	v := dump(t, db2, "select distinct typeof(name) from foo")
+	if v != `[["text"]]` {
+		t.Error("Wrong type", v)
+	}
+
+	v = dump(t, db2, "select count(*) from __DBCHG__")
+	if v != `[["0"]]` {
+		t.Error("Captured changes not cleared", v)
+	}
+}
+
+func TestLogRowsReplace(t *testing.T) {
+	nodes := []*SyncDB{}
+	for _, id := range []string{node1, node2} {
+		db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0", LogMode: LogRows})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(context.Background())
+		tx, _ := db.Begin()
+		tx.Set("id", id)
+		tx.Commit()
+		nodes = append(nodes, db)
+	}
+	db1, db2 := nodes[0], nodes[1]
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer primary key, name text unique)", []interface{}{})
+	tx.Exec("insert into foo values (1, 'a'), (2, 'c')", []interface{}{})
+	tx.Commit()
+
+	err := db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the rows removed by REPLACE, by key or by other unique column, are
+	//captured as deletes
+	tx, _ = db1.Begin()
+	err = tx.Exec("insert or replace into foo values (1, 'b')", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Exec("replace into foo values (3, 'c')", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	err = db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql := "select * from foo order by id"
+	if d1, d2 := dump(t, db1, sql), dump(t, db2, sql); d1 != `[["1","b"],["3","c"]]` || d1 != d2 {
+		t.Error("Different contents", d1, d2)
+	}
+	quarantined, err := db2.QuarantinedTxs()
+	if err != nil || len(quarantined) != 0 {
+		t.Error("Replace not applied", quarantined, err)
+	}
+}
@@ -12,8 +12,8 @@ var (
 )
 
 //Get value of the key from setting
-func (db *SyncDB) Get(key string) (string, error) {
-	res, _, err := db.Query("SELECT value FROM SETTINGS WHERE KEY = ?", []interface{}{key})
+func (tx *Tx) Get(key string) (string, error) {
+	res, _, err := tx.Query("SELECT value FROM SETTINGS WHERE KEY = ?", []interface{}{key})
 	if err != nil {
 		return "", err
 	}
@@ -26,13 +26,13 @@ func (db *SyncDB) Get(key string) (string, error) {
 }
 
 //Set value to key into settings
-func (db *SyncDB) Set(key, value string) error {
-	err := db.ExecWithoutLog("DELETE FROM SETTINGS WHERE KEY = ?", []interface{}{key})
+func (tx *Tx) Set(key, value string) error {
+	err := tx.ExecWithoutLog("DELETE FROM SETTINGS WHERE KEY = ?", []interface{}{key})
 	if err != nil {
 		return err
 	}
 
-	err = db.ExecWithoutLog("INSERT INTO SETTINGS(ID, KEY, VALUE) VALUES(null, ?,?)", []interface{}{key, value})
+	err = tx.ExecWithoutLog("INSERT INTO SETTINGS(ID, KEY, VALUE) VALUES(null, ?,?)", []interface{}{key, value})
 	if err != nil {
 		return err
 	}
@@ -41,13 +41,13 @@ func (db *SyncDB) Set(key, value string) error {
 }
 
 //GSet value to key into settings for all p2p network
-func (db *SyncDB) GSet(key, value string) error {
-	err := db.Exec("DELETE FROM SETTINGS WHERE KEY = ?", []interface{}{key})
+func (tx *Tx) GSet(key, value string) error {
+	err := tx.Exec("DELETE FROM SETTINGS WHERE KEY = ?", []interface{}{key})
 	if err != nil {
 		return err
 	}
 
-	err = db.Exec("INSERT INTO SETTINGS(ID, KEY, VALUE) VALUES(null, ?,?)", []interface{}{key, value})
+	err = tx.Exec("INSERT INTO SETTINGS(ID, KEY, VALUE) VALUES(null, ?,?)", []interface{}{key, value})
 	if err != nil {
 		return err
 	}
@@ -56,16 +56,30 @@ func (db *SyncDB) GSet(key, value string) error {
 }
 
 func (db *SyncDB) initSettings() error {
-	db.Begin()
-	defer db.Commit()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit()
 
-	_, err := db.Get("id")
+	_, err = tx.Get("id")
 	if err != nil {
 		id, err := uuid.NewV4()
 		if err != nil {
 			return err
 		}
-		db.Set("id", id.String())
+		tx.Set("id", id.String())
 	}
 	return nil
 }
+
+//nodeID return the id of this node
+func (db *SyncDB) nodeID() (string, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Commit()
+
+	return tx.Get("id")
+}
@@ -1,6 +1,7 @@
 package syncdb
 
 import (
+	"context"
 	"testing"
 )
 
@@ -10,23 +11,24 @@ func TestSettingsSimplet(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db.Close(context.Background())
 
-	err = db.Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, err = db.Get("foo")
+	_, err = tx.Get("foo")
 	if err == nil {
 		t.Error(err)
 	}
 
-	err = db.Set("foo", "bar")
+	err = tx.Set("foo", "bar")
 	if err != nil {
 		t.Error(err)
 	}
 
-	val, err := db.Get("foo")
+	val, err := tx.Get("foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -35,7 +37,7 @@ func TestSettingsSimplet(t *testing.T) {
 		t.Error("val value not expected")
 	}
 
-	err = db.Commit()
+	err = tx.Commit()
 	if err != nil {
 		t.Error(err)
 	}
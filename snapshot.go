@@ -0,0 +1,357 @@
+package syncdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+var (
+	//ErrNotEmpty is returned by BootstrapFrom in a node that already has txs
+	ErrNotEmpty = errors.New("Bootstrap needs a database without txs")
+
+	//ErrSnapshotNotSupported is returned by nodes without /snapshot
+	ErrSnapshotNotSupported = errors.New("node don't support snapshots")
+
+	//ErrSnapshotMismatch is returned when the snapshot received don't have
+	//the txs announced by the peer
+	ErrSnapshotMismatch = errors.New("snapshot don't match its version vector")
+
+	errBackupIncomplete = errors.New("backup not completed")
+)
+
+//headerVector carry the version vector of the txs included in a snapshot
+const headerVector = "X-Syncdb-Vector"
+
+//backup copy the main database of src to dest, with the SQLite online
+//backup API
+func backup(dest, src *sql.Conn) error {
+	return dest.Raw(func(d interface{}) error {
+		return src.Raw(func(s interface{}) error {
+			b, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			done, err := b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return err
+			}
+			if !done {
+				b.Finish()
+				return errBackupIncomplete
+			}
+			return b.Finish()
+		})
+	})
+}
+
+//copyDB copy the database to the file arq. The copy is made in one step,
+//so it is consistent
+func (db *SyncDB) copyDB(arq string) error {
+	ctx := context.Background()
+	file, err := sql.Open("sqlite3", arq)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fconn, err := file.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer fconn.Close()
+
+	conn, err := db.readers.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return backup(fconn, conn)
+}
+
+//snapshotVector return the version vector of the database in the file arq
+func snapshotVector(arq string) (syncVector, error) {
+	file, err := sql.Open("sqlite3", arq)
+	if err != nil {
+		return syncVector{}, err
+	}
+	defer file.Close()
+
+	_, err = file.Exec("PRAGMA INTEGRITY_CHECK")
+	if err != nil {
+		return syncVector{}, err
+	}
+
+	snapshot := &SyncDB{sqlite: file, readers: file}
+	return snapshot.localVector()
+}
+
+//tempFile return the name of a new empty temporary file
+func tempFile() (string, error) {
+	f, err := ioutil.TempFile("", "syncdb-snapshot-*.db")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value(keyDB).(*SyncDB)
+
+	arq, err := tempFile()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(arq)
+
+	err = db.copyDB(arq)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//the txs included are the ones in the copy
+	v, err := snapshotVector(arq)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	v.ID, err = db.nodeID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(arq)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set(headerVector, string(b))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, f)
+}
+
+//getSnapshotFromNode save the snapshot of the node in a temporary file,
+//it return the file name and the version vector of the snapshot
+func getSnapshotFromNode(ctx context.Context, ip, port string) (string, syncVector, error) {
+	v := syncVector{}
+	res, err := httpGet(ctx, "http://"+ip+":"+port+"/snapshot")
+	if err != nil {
+		return "", v, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", v, statusError(res, ErrSnapshotNotSupported)
+	}
+	err = json.Unmarshal([]byte(res.Header.Get(headerVector)), &v)
+	if err != nil {
+		return "", v, err
+	}
+
+	arq, err := tempFile()
+	if err != nil {
+		return "", v, err
+	}
+	f, err := os.OpenFile(arq, os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = io.Copy(f, res.Body)
+		errClose := f.Close()
+		if err == nil {
+			err = errClose
+		}
+	}
+	if err != nil {
+		os.Remove(arq)
+		return "", v, err
+	}
+
+	return arq, v, nil
+}
+
+//sameTxs report if the vectors have the same txs
+func sameTxs(v1, v2 syncVector) bool {
+	if v1.Legacy != v2.Legacy || len(v1.Seqs) != len(v2.Seqs) {
+		return false
+	}
+	for origin, seq := range v1.Seqs {
+		if v2.Seqs[origin] != seq {
+			return false
+		}
+	}
+	return true
+}
+
+//BootstrapFrom install in this node a snapshot of the peer ("host:port"),
+//instead of receive and execute all its txs, and then sync with it as
+//usual. The node must not have txs. The node id and company are kept, the
+//other SETTINGS are the ones of the peer: GSet values are replicated with
+//the txs, so local values set by the peer come too
+func (db *SyncDB) BootstrapFrom(peer string) error {
+	return db.BootstrapFromContext(context.Background(), peer)
+}
+
+//BootstrapFromContext is BootstrapFrom with a context, the download of the
+//snapshot and the sync are canceled when ctx end
+func (db *SyncDB) BootstrapFromContext(ctx context.Context, peer string) error {
+	ip, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return err
+	}
+
+	//fail early, the install check it again
+	tx, err := db.BeginForQueryCtx(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := tx.count("SELECT COUNT(*) FROM __DBTX__")
+	tx.Commit()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrNotEmpty
+	}
+
+	arq, v, err := getSnapshotFromNode(ctx, ip, port)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(arq)
+
+	local, err := snapshotVector(arq)
+	if err != nil {
+		return err
+	}
+	if !sameTxs(local, v) {
+		return ErrSnapshotMismatch
+	}
+
+	err = db.installSnapshot(ctx, arq)
+	if err != nil {
+		return err
+	}
+
+	return db.syncWithNode(ctx, ip, port)
+}
+
+//installSnapshot replace the database by the snapshot in the file arq,
+//keeping the node id and company of this node. The writer slot is held
+//from the check of the txs to the end, so no local tx is overwritten
+func (db *SyncDB) installSnapshot(ctx context.Context, arq string) error {
+	err := db.startApply()
+	if err != nil {
+		return err
+	}
+	defer db.applying.Done()
+
+	err = db.restoreSnapshot(ctx, arq)
+	if err != nil {
+		return err
+	}
+
+	//the clock of the txs installed
+	return db.loadClock()
+}
+
+func (db *SyncDB) restoreSnapshot(ctx context.Context, arq string) error {
+	file, err := sql.Open("sqlite3", arq)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fconn, err := file.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer fconn.Close()
+
+	err = db.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.unlock()
+
+	conn, err := db.sqlite.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var n int
+	var id, company sql.NullString
+	err = conn.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM __DBTX__),
+		(SELECT VALUE FROM SETTINGS WHERE KEY = 'id'), (SELECT VALUE FROM SETTINGS WHERE KEY = 'company')`).
+		Scan(&n, &id, &company)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrNotEmpty
+	}
+
+	err = backup(conn, fconn)
+	if err != nil {
+		return err
+	}
+
+	//peers and quarantine are state of the node the snapshot came from
+	tx, err := db.beginOn(ctx, conn)
+	if err != nil {
+		return err
+	}
+	err = tx.Set("id", id.String)
+	if err == nil && company.Valid {
+		err = tx.Set("company", company.String)
+	}
+	if err == nil {
+		err = tx.ExecWithoutLog("DELETE FROM __DBPEER__", []interface{}{})
+	}
+	if err == nil {
+		err = tx.ExecWithoutLog("DELETE FROM __DBQUARANTINE__", []interface{}{})
+	}
+	if err == nil {
+		err = tx.configureCapture()
+	}
+	if err == nil {
+		err = tx.configureVersions()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,99 @@
+package syncdb
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+	tx, _ = db1.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Commit()
+
+	peer := net.JoinHostPort("127.0.0.1", strconv.Itoa(db1.port))
+	err := db2.BootstrapFrom(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := fooNames(t, db2); names != "teste1,teste2" {
+		t.Error("Snapshot not installed", names)
+	}
+	if id, _ := db2.nodeID(); id != node2 {
+		t.Error("Node id not kept", id)
+	}
+	v, _ := db2.localVector()
+	if v.Seqs[node1] != 2 {
+		t.Error("Wrong vector after bootstrap", v.Seqs)
+	}
+
+	//the sync continue after the snapshot
+	tx, _ = db2.Begin()
+	tx.Exec("insert into foo values (3, ?)", []interface{}{"teste3"})
+	tx.Commit()
+	err = db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := fooNames(t, db1); names != "teste1,teste2,teste3" {
+		t.Error("Tx after bootstrap not synced", names)
+	}
+	v, _ = db1.localVector()
+	if v.Seqs[node2] != 1 {
+		t.Error("Wrong sequence after bootstrap", v.Seqs)
+	}
+
+	err = db2.BootstrapFrom(peer)
+	if err != ErrNotEmpty {
+		t.Error("Bootstrap of a node with txs", err)
+	}
+}
+
+func TestBootstrapLocalCommit(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := db2.BootstrapFromContext(ctx, net.JoinHostPort("127.0.0.1", strconv.Itoa(db1.port)))
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Error("Expected canceled bootstrap", err)
+	}
+
+	arq, _, err := getSnapshotFromNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(arq)
+
+	//a tx committed during the download is not overwritten
+	tx, _ = db2.Begin()
+	tx.Exec("create table bar(id integer not null primary key)", []interface{}{})
+	tx.Commit()
+	err = db2.installSnapshot(context.Background(), arq)
+	if err != ErrNotEmpty {
+		t.Error("Expected ErrNotEmpty", err)
+	}
+	if tables := dump(t, db2, "select name from sqlite_master where name in ('foo', 'bar')"); tables != `[["bar"]]` {
+		t.Error("Local tx overwritten", tables)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package syncdb
+
+import "syscall"
+
+//broadcastControl set SO_BROADCAST, to send to broadcast addresses, and
+//SO_REUSEADDR, so the nodes of the host listen the same port
+func broadcastControl(network, address string, c syscall.RawConn) error {
+	var err error
+	errControl := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+		if err == nil {
+			err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}
+	})
+	if errControl != nil {
+		return errControl
+	}
+	return err
+}
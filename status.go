@@ -0,0 +1,232 @@
+package syncdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//PeerStatus is the health of the sync with a peer
+type PeerStatus struct {
+	//Addr is the "host:port" of the peer, empty for peers that only
+	//contacted this node
+	Addr string
+	//ID is the node id, empty until the peer send its vector
+	ID          string `json:",omitempty"`
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+	//TxsSent and TxsReceived count the txs exchanged since the start
+	TxsSent     int64
+	TxsReceived int64
+	//RTT is the time of the last exchange of txs
+	RTT time.Duration
+	//LastSeen is the last contact in any direction, and Lag the number of
+	//txs of this node the peer don't have, from its acknowledgement
+	LastSeen string
+	Lag      int64
+}
+
+//Status is the sync state of the node
+type Status struct {
+	ID string
+	//Txs is the number of txs in the log, LogEntries and LogBytes the
+	//size of their statements
+	Txs         int64
+	LogEntries  int64
+	LogBytes    int64
+	Quarantined int64
+	//OldestUnacked is the datetime of the oldest tx that some known peer
+	//don't have, empty when all peers have all txs
+	OldestUnacked string
+	Peers         []PeerStatus
+}
+
+//syncStats is the health of the syncs started by this node, by peer
+//address. It is not persisted
+type syncStats struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStatus
+}
+
+func (s *syncStats) peer(addr string) *PeerStatus {
+	if s.peers == nil {
+		s.peers = map[string]*PeerStatus{}
+	}
+	p, ok := s.peers[addr]
+	if !ok {
+		p = &PeerStatus{Addr: addr}
+		s.peers[addr] = p
+	}
+	return p
+}
+
+//attempt record the result of a sync with the peer
+func (s *syncStats) attempt(addr string, start time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peer(addr)
+	p.LastAttempt = start
+	if err != nil {
+		p.LastError = err.Error()
+		return
+	}
+	p.LastSuccess, p.LastError = start, ""
+}
+
+//exchanged record the txs exchanged with the peer
+func (s *syncStats) exchanged(addr string, sent, received int, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peer(addr)
+	p.TxsSent += int64(sent)
+	p.TxsReceived += int64(received)
+	p.RTT = rtt
+}
+
+//list return a copy of the peer records
+func (s *syncStats) list() []PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := []PeerStatus{}
+	for _, p := range s.peers {
+		ret = append(ret, *p)
+	}
+	return ret
+}
+
+//count return the number in the first column of the query
+func (tx *Tx) count(sql string) (int64, error) {
+	res, _, err := tx.Query(sql, []interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(*res[0][0].(*string), 10, 64)
+}
+
+//Status return the sync state of the node and the health of each peer
+func (db *SyncDB) Status() (Status, error) {
+	st := Status{}
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return st, err
+	}
+	defer tx.Commit()
+
+	st.ID, err = tx.Get("id")
+	if err != nil {
+		return st, err
+	}
+
+	for _, c := range []struct {
+		dest *int64
+		sql  string
+	}{
+		{&st.Txs, "SELECT COUNT(*) FROM __DBTX__"},
+		{&st.LogEntries, "SELECT COUNT(*) FROM __DBLOG__"},
+		{&st.LogBytes, "SELECT IFNULL(SUM(LENGTH(SQL)), 0) FROM __DBLOG__"},
+		{&st.Quarantined, "SELECT COUNT(*) FROM __DBQUARANTINE__"},
+	} {
+		*c.dest, err = tx.count(c.sql)
+		if err != nil {
+			return st, err
+		}
+	}
+
+	peers, err := tx.peers("", []interface{}{})
+	if err != nil {
+		return st, err
+	}
+	st.OldestUnacked, err = tx.oldestUnacked(peers)
+	if err != nil {
+		return st, err
+	}
+
+	//the syncs started by this node, with the acknowledgement of the peer
+	known := map[string]bool{}
+	for _, p := range db.stats.list() {
+		for _, info := range peers {
+			if info.Addr == p.Addr {
+				p.ID, p.LastSeen, p.Lag = info.ID, info.LastSeen, info.Lag
+				known[info.ID] = true
+			}
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	for _, info := range peers {
+		if !known[info.ID] {
+			st.Peers = append(st.Peers, PeerStatus{Addr: info.Addr, ID: info.ID, LastSeen: info.LastSeen,
+				Lag: info.Lag})
+		}
+	}
+	sort.Slice(st.Peers, func(i, j int) bool {
+		if st.Peers[i].ID != st.Peers[j].ID {
+			return st.Peers[i].ID < st.Peers[j].ID
+		}
+		return st.Peers[i].Addr < st.Peers[j].Addr
+	})
+
+	return st, nil
+}
+
+//oldestUnacked return the datetime of the oldest tx not acknowledged by
+//some of the peers, it must be in a transaction
+func (tx *Tx) oldestUnacked(peers []PeerInfo) (string, error) {
+	if len(peers) == 0 {
+		return "", nil
+	}
+
+	local, err := tx.vector()
+	if err != nil {
+		return "", err
+	}
+
+	oldest := ""
+	for origin, seq := range local.Seqs {
+		acked := seq
+		for _, p := range peers {
+			if p.Acked[origin] < acked {
+				acked = p.Acked[origin]
+			}
+		}
+		if acked == seq {
+			continue
+		}
+
+		res, _, err := tx.Query("SELECT IFNULL(MIN(DATETIME), '') FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ > ?",
+			[]interface{}{origin, acked})
+		if err != nil {
+			return "", err
+		}
+		if dt := *res[0][0].(*string); len(dt) > 0 && (len(oldest) == 0 || dt < oldest) {
+			oldest = dt
+		}
+	}
+	return oldest, nil
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value(keyDB).(*SyncDB)
+
+	st, err := db.Status()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
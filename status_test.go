@@ -0,0 +1,74 @@
+package syncdb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(db2.port))
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+	tx, _ = db2.Begin()
+	tx.Exec("create table bar(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a failed sync don't change the last success
+	db1.syncWithNode(context.Background(), "127.0.0.1", "1")
+
+	st, err := db1.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != node1 || st.Txs != 2 || st.LogEntries != 2 || st.LogBytes == 0 || st.Quarantined != 0 {
+		t.Error("Wrong local status", st)
+	}
+	//db2 acknowledged only the vector before the sync
+	if len(st.OldestUnacked) == 0 {
+		t.Error("Unacknowledged tx not reported", st)
+	}
+	if len(st.Peers) != 2 {
+		t.Fatal("Wrong peers", st.Peers)
+	}
+	failed, p := st.Peers[0], st.Peers[1]
+	if p.ID != node2 || p.Addr != addr || p.LastSuccess.IsZero() || p.LastError != "" ||
+		p.TxsSent != 1 || p.TxsReceived != 1 || p.RTT <= 0 || p.Lag != 1 {
+		t.Error("Wrong peer status", p)
+	}
+	if failed.ID != "" || failed.LastAttempt.IsZero() || !failed.LastSuccess.IsZero() || failed.LastError == "" {
+		t.Error("Wrong failed peer status", failed)
+	}
+
+	//db2 know db1 only by its contact, and the vector sent before it
+	//received the tx of db2
+	res, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	st = Status{}
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != node2 || len(st.Peers) != 1 || st.Peers[0].ID != node1 || st.Peers[0].Addr != "" ||
+		!st.Peers[0].LastAttempt.IsZero() || st.Peers[0].Lag != 1 || len(st.OldestUnacked) == 0 {
+		t.Error("Wrong status of server", st)
+	}
+}
@@ -2,6 +2,7 @@ package syncdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	rum "github.com/rumlang/rum/runtime"
 )
@@ -19,7 +22,8 @@ var (
 	//ErrIDNotFound error when the key is not found on setting
 	ErrIDNotFound = errors.New("Error getting ID from txlogs tables")
 
-	//URLDiscoverService is where the sync system get info about the nodes on companies
+	//URLDiscoverService is where the sync system get info about the nodes on companies,
+	//used when SyncDB has no Discoverer
 	URLDiscoverService = "https://piscine-monsieur-96181.herokuapp.com"
 
 	RumContext *rum.Context
@@ -34,25 +38,35 @@ type logReg struct {
 type txReg struct {
 	ID         string
 	TxDatetime string
+	Origin     string `json:",omitempty"`
+	OSeq       int64  `json:",omitempty"`
+	HLC        string `json:",omitempty"`
 	SQLs       []logReg
 }
 
+//msgDiff carry the txs the peer don't have and what is wanted from it:
+//the txs by id (IWant) or all txs after the version vector (Vector).
+//From and Legacy identify the sender and complete its vector
 type msgDiff struct {
-	IHas  []txReg
-	IWant []string
-}
-
-//NodeInfo is info about node
-type NodeInfo struct {
-	IP   string
-	Port string
-	Rum  string
+	IHas   []txReg
+	IWant  []string
+	Vector map[string]int64
+	From   string `json:",omitempty"`
+	Legacy string `json:",omitempty"`
 }
 
 func handleGetAllUUIDs(w http.ResponseWriter, r *http.Request) {
 	db := r.Context().Value(keyDB).(*SyncDB)
+	db.metrics.request("/txs")
 
-	uuids, err := db.getAllUUIDSLocal()
+	var uuids []string
+	var err error
+	legacy := r.URL.Query().Get("legacy") == "1"
+	if prefixes := r.URL.Query()["p"]; len(prefixes) > 0 {
+		uuids, err = db.prefixedUUIDs(prefixes, legacy)
+	} else {
+		uuids, err = db.getAllUUIDSLocal(legacy)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -72,6 +86,7 @@ func handleGetAllUUIDs(w http.ResponseWriter, r *http.Request) {
 
 func handleDiffs(w http.ResponseWriter, r *http.Request) {
 	db := r.Context().Value(keyDB).(*SyncDB)
+	db.metrics.request("/diffs")
 
 	//Get Message
 	body, err := ioutil.ReadAll(r.Body)
@@ -86,26 +101,58 @@ func handleDiffs(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "[]")
+		return
 	}
 
-	//process received txs
-	db.syncRegister(msg.IHas)
+	//process received txs, the failed ones are received again in the next sync
+	err = db.applyReceived(r.Context(), r.RemoteAddr, msg.IHas, false)
+	if err != nil {
+		log.Println(err)
+	}
+
+	//older nodes don't send their id
+	if msg.From == "" {
+		err = db.legacySeen()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	//the sender has the txs of its vector
+	if msg.Vector != nil {
+		err = db.recordPeer(syncVector{ID: msg.From, Seqs: msg.Vector, Legacy: msg.Legacy}, "")
+		if err != nil {
+			log.Println(err)
+		}
+	}
 
 	//Get requested content
-	ihas, err := db.uuids2txRegs(msg.IWant)
+	var ihas []txReg
+	if msg.Vector != nil {
+		ihas, err = db.txsSince(msg.Vector)
+	} else {
+		ihas, err = db.uuids2txRegs(msg.IWant)
+	}
+	if err == ErrBootstrapRequired {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "[]")
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "[]")
+		return
 	}
 
 	b, err := json.Marshal(ihas)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "[]")
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 
 	w.Write(b)
 }
@@ -128,32 +175,25 @@ func getMyIPs() ([]string, error) {
 	return ips, nil
 }
 
-func discoverNodes(ip []string, company, port, id string) (map[string]NodeInfo, error) {
-	res, err := http.Get(URLDiscoverService + "/?i=" + strings.Join(ip, ",") +
-		"&c=" + company + "&p=" + port + "&id=" + id)
-	if err != nil {
-		return nil, err
-	}
-
-	text, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return nil, err
-	}
-
-	nodes := map[string]NodeInfo{}
-	err = json.Unmarshal(text, &nodes)
-	if err != nil {
-		return nil, err
-	}
+//Sync initialize sync procedure from db node. It sync with all nodes and
+//return the first error
+func (db *SyncDB) Sync() error {
+	return db.SyncContext(context.Background())
+}
 
-	return nodes, nil
+//SyncContext is Sync with a context, the requests to the nodes and the
+//txs being applied are canceled when ctx end. The txs not applied are
+//received in the next sync
+func (db *SyncDB) SyncContext(ctx context.Context) error {
+	return db.syncNodes(ctx, nil, nil)
 }
 
-//Sync initialize sync procedure from db node
-func (db *SyncDB) Sync() error {
+//syncNodes sync with the nodes discovered, except the addresses ("ip:port")
+//not allowed. The result of each node is reported, when report is not nil
+func (db *SyncDB) syncNodes(ctx context.Context, allow func(addr string) bool,
+	report func(addr string, err error)) error {
 	log.Println("Init Sync")
-	ips, err := getMyIPs()
+	ips, port, err := db.advertise()
 	if err != nil {
 		log.Println(err)
 		return err
@@ -161,24 +201,24 @@ func (db *SyncDB) Sync() error {
 
 	log.Println("*** Getting sync info")
 	//Get info
-	err = db.Begin()
+	tx, err := db.BeginForQuery()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	company, err := db.Get("company")
+	company, err := tx.Get("company")
 	if err != nil {
 		log.Println(err)
-		db.Rollback()
+		tx.Rollback()
 		return err
 	}
-	id, err := db.Get("id")
+	id, err := tx.Get("id")
 	if err != nil {
 		log.Println(err)
-		db.Rollback()
+		tx.Rollback()
 		return err
 	}
-	err = db.Rollback()
+	err = tx.Rollback()
 	if err != nil {
 		log.Println(err)
 		return err
@@ -187,21 +227,29 @@ func (db *SyncDB) Sync() error {
 
 	//discover nodes
 	log.Println("Discovering nodes")
-	nodes, err := discoverNodes(ips, company, strconv.Itoa(db.port), id)
+	nodes, err := db.discover(ctx, ips, company, port, id)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
+	var first error
 	for key, val := range nodes {
 		if key != id {
 			rips := strings.Split(val.IP, ",")
 			for _, ip := range rips {
-				if ip != "127.0.0.1" {
+				addr := net.JoinHostPort(ip, val.Port)
+				if ip != "127.0.0.1" && (allow == nil || allow(addr)) {
 					log.Println("Sync with node", ip, val.Port)
-					err = db.syncWithNode(ip, val.Port)
+					err = db.syncWithNode(ctx, ip, val.Port)
 					if err != nil {
 						log.Println(err)
+						if first == nil {
+							first = err
+						}
+					}
+					if report != nil {
+						report(addr, err)
 					}
 				}
 			}
@@ -218,15 +266,19 @@ func (db *SyncDB) Sync() error {
 		}
 	}
 
-	return nil
+	return first
 }
 
 func (db *SyncDB) uuid2txReg(uuid string) (txReg, error) {
-	db.BeginForQuery()
-	defer db.Commit()
-
 	txReg := txReg{}
-	res, _, err := db.Query("select id, datetime from __DBTX__ where id=? order by datetime", []interface{}{uuid})
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return txReg, err
+	}
+	defer tx.Commit()
+
+	res, _, err := tx.Query(`select id, datetime, ifnull(origin, ''), ifnull(oseq, 0), ifnull(hlc, '')
+		from __DBTX__ where id=?`, []interface{}{uuid})
 	if err != nil {
 		return txReg, err
 	}
@@ -236,8 +288,11 @@ func (db *SyncDB) uuid2txReg(uuid string) (txReg, error) {
 
 	txReg.ID = *res[0][0].(*string)
 	txReg.TxDatetime = *res[0][1].(*string)
+	txReg.Origin = *res[0][2].(*string)
+	txReg.OSeq, _ = strconv.ParseInt(*res[0][3].(*string), 10, 64)
+	txReg.HLC = *res[0][4].(*string)
 
-	res, _, err = db.Query("select id, seq, sql from __DBLOG__ where txid=? order by seq", []interface{}{uuid})
+	res, _, err = tx.Query("select id, seq, sql from __DBLOG__ where txid=? order by seq", []interface{}{uuid})
 	if err != nil {
 		return txReg, err
 	}
@@ -263,73 +318,186 @@ func (db *SyncDB) uuids2txRegs(uuids []string) ([]txReg, error) {
 		}
 		ret = append(ret, txreg)
 	}
+
+	//apply order
+	sort.SliceStable(ret, func(i, j int) bool {
+		return txOrderKey(ret[i].HLC, ret[i].TxDatetime, ret[i].ID) <
+			txOrderKey(ret[j].HLC, ret[j].TxDatetime, ret[j].ID)
+	})
 	return ret, nil
 }
 
-func (db *SyncDB) syncWithNode(ip, port string) error {
-	//get remote uuids
-	ruuids, err := getAllUUIDSFromNode(ip, port)
+//syncWithNode exchange with the node the txs after the version vector of
+//each other, and record the result in the peer status
+func (db *SyncDB) syncWithNode(ctx context.Context, ip, port string) error {
+	start := time.Now()
+	err := db.syncWithNodeVector(ctx, ip, port)
+	db.stats.attempt(net.JoinHostPort(ip, port), start, err)
+	db.metrics.synced(net.JoinHostPort(ip, port), time.Since(start))
+	return err
+}
+
+//syncWithNodeVector exchange with the node the txs after the version vector
+//of each other, when the vectors differ. Nodes without vectors are synced
+//by the full list of txs
+func (db *SyncDB) syncWithNodeVector(ctx context.Context, ip, port string) error {
+	rvector, err := getVectorFromNode(ctx, ip, port)
+	if err == ErrVectorNotSupported {
+		err = db.legacySeen()
+		if err != nil {
+			return err
+		}
+		return db.syncWithNodeUUIDs(ctx, ip, port, false)
+	}
 	if err != nil {
 		return err
 	}
 
-	//get local uuids
-	luuids, err := db.getAllUUIDSLocal()
+	err = db.recordPeer(rvector, net.JoinHostPort(ip, port))
 	if err != nil {
 		return err
 	}
 
-	onlyRemote := uuidsDiff(ruuids, luuids)
-	onlyLocal := uuidsDiff(luuids, ruuids)
+	lvector, err := db.localVector()
+	if err != nil {
+		return err
+	}
 
-	ihas, err := db.uuids2txRegs(onlyLocal)
+	//nothing to exchange when both nodes have the same txs
+	if sameTxs(lvector, rvector) {
+		log.Println("Node up to date", ip, port)
+		return nil
+	}
+
+	//a node before our pruned txs only get them by bootstrap, it is told
+	//when it sync with us; it don't get the txs after, with a gap
+	ihas, err := db.txsSince(rvector.Seqs)
+	if err == ErrBootstrapRequired {
+		log.Println("Node needs bootstrap", ip, port)
+		ihas = []txReg{}
+	} else if err != nil {
+		return err
+	}
+
+	id, err := db.nodeID()
 	if err != nil {
 		return err
 	}
 
 	msg := msgDiff{
-		IHas:  ihas,
-		IWant: onlyRemote}
+		IHas:   ihas,
+		Vector: lvector.Seqs,
+		From:   id,
+		Legacy: lvector.Legacy}
 
-	b, err := json.Marshal(msg)
+	txs, err := db.exchangeTxs(ctx, ip, port, msg)
 	if err != nil {
 		return err
 	}
 
-	txs, err := sendReceiveTXS(ip, port, b)
+	//process received txs
+	errApply := db.syncRegister(ctx, net.JoinHostPort(ip, port), txs)
+
+	//txs without origin are only known by id
+	if rvector.Legacy != lvector.Legacy {
+		err = db.legacySeen()
+		if err != nil {
+			return err
+		}
+		err = db.syncWithNodeUUIDs(ctx, ip, port, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errApply
+}
+
+//syncWithNodeUUIDs exchange the txs that only one of the nodes have
+//(or only the legacy txs, without origin), found by reconciliation or,
+//for older nodes, comparing the list of all txs
+func (db *SyncDB) syncWithNodeUUIDs(ctx context.Context, ip, port string, legacy bool) error {
+	onlyRemote, onlyLocal, err := db.reconcileWithNode(ctx, ip, port, legacy)
+	if err == ErrReconcileNotSupported {
+		onlyRemote, onlyLocal, err = db.diffWithNode(ctx, ip, port, legacy)
+	}
 	if err != nil {
 		return err
 	}
 
-	//process received txs
-	db.syncRegister(txs)
+	//older nodes list the pruned txs, they are not requested again
+	onlyRemote, err = db.withoutPruned(onlyRemote)
+	if err != nil {
+		return err
+	}
+
+	ihas, err := db.uuids2txRegs(onlyLocal)
+	if err != nil {
+		return err
+	}
+
+	id, err := db.nodeID()
+	if err != nil {
+		return err
+	}
+
+	msg := msgDiff{
+		IHas:  ihas,
+		IWant: onlyRemote,
+		From:  id}
+
+	txs, err := db.exchangeTxs(ctx, ip, port, msg)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	//process received txs
+	return db.syncRegister(ctx, net.JoinHostPort(ip, port), txs)
 }
 
-func containsUUID(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
+//diffWithNode compare the list of all txs of the node with the local list
+func (db *SyncDB) diffWithNode(ctx context.Context, ip, port string,
+	legacy bool) (onlyRemote, onlyLocal []string, err error) {
+	//get remote uuids
+	ruuids, err := getAllUUIDSFromNode(ctx, ip, port, legacy)
+	if err != nil {
+		return nil, nil, err
 	}
-	return false
+
+	//get local uuids
+	luuids, err := db.getAllUUIDSLocal(legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return uuidsDiff(ruuids, luuids), uuidsDiff(luuids, ruuids), nil
 }
 
 func uuidsDiff(uuids1, uuids2 []string) (res []string) {
+	set := make(map[string]bool, len(uuids2))
+	for _, a := range uuids2 {
+		set[a] = true
+	}
 	for _, a := range uuids1 {
-		if !containsUUID(uuids2, a) {
+		if !set[a] {
 			res = append(res, a)
 		}
 	}
 	return
 }
 
-func (db *SyncDB) getAllUUIDSLocal() ([]string, error) {
-	db.BeginForQuery()
-	defer db.Commit()
+func (db *SyncDB) getAllUUIDSLocal(legacy bool) ([]string, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
 
-	res, _, err := db.Query("SELECT ID FROM __DBTX__ ORDER BY DATETIME ", []interface{}{})
+	where := ""
+	if legacy {
+		where = "WHERE ORIGIN IS NULL "
+	}
+	res, _, err := tx.Query("SELECT ID FROM __DBTX__ "+where+"ORDER BY HLC, DATETIME, ID", []interface{}{})
 	if err != nil {
 		return nil, err
 	}
@@ -342,8 +510,21 @@ func (db *SyncDB) getAllUUIDSLocal() ([]string, error) {
 	return ret, nil
 }
 
-func getAllUUIDSFromNode(ip, port string) ([]string, error) {
-	res, err := http.Get("http://" + ip + ":" + port + "/txs")
+//httpGet get the url, the request is canceled when ctx end
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func getAllUUIDSFromNode(ctx context.Context, ip, port string, legacy bool) ([]string, error) {
+	url := "http://" + ip + ":" + port + "/txs"
+	if legacy {
+		url += "?legacy=1"
+	}
+	res, err := httpGet(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -363,9 +544,31 @@ func getAllUUIDSFromNode(ip, port string) ([]string, error) {
 	return uuids, nil
 }
 
-func sendReceiveTXS(ip, port string, txs []byte) ([]txReg, error) {
+//exchangeTxs send msg to the node and return the txs received, the
+//exchange is recorded in the peer status
+func (db *SyncDB) exchangeTxs(ctx context.Context, ip, port string, msg msgDiff) ([]txReg, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	txs, err := sendReceiveTXS(ctx, ip, port, b)
+	if err != nil {
+		return nil, err
+	}
+	db.stats.exchanged(net.JoinHostPort(ip, port), len(msg.IHas), len(txs), time.Since(start))
+	return txs, nil
+}
+
+func sendReceiveTXS(ctx context.Context, ip, port string, txs []byte) ([]txReg, error) {
 	r := bytes.NewReader(txs)
-	res, err := http.Post("http://"+ip+":"+port+"/diffs", "application/json; charset=utf-8", r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+ip+":"+port+"/diffs", r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -375,6 +578,10 @@ func sendReceiveTXS(ip, port string, txs []byte) ([]txReg, error) {
 	if err != nil {
 		return nil, err
 	}
+	//the txs this node need were pruned by the node
+	if res.StatusCode == http.StatusGone {
+		return nil, ErrBootstrapRequired
+	}
 
 	regs := []txReg{}
 	err = json.Unmarshal(text, &regs)
@@ -386,31 +593,203 @@ func sendReceiveTXS(ip, port string, txs []byte) ([]txReg, error) {
 
 }
 
-func (db *SyncDB) syncRegister(txs []txReg) error {
+//TxApplyError is returned when a remote tx fail to apply. Nothing of the
+//tx is written and it go to quarantine, to retry in the next sync
+type TxApplyError struct {
+	TxID string
+	//Statement is the entry that failed, empty when the tx failed as a whole
+	Statement SQLreg
+	Err       error
+}
+
+func (e *TxApplyError) Error() string {
+	if len(e.Statement.SQL) > 0 {
+		return "tx " + e.TxID + " not applied: " + e.Statement.SQL + ": " + e.Err.Error()
+	}
+	return "tx " + e.TxID + " not applied: " + e.Err.Error()
+}
+
+var errTxDeferred = errors.New("tx deferred by conflict resolver")
+
+//applyRemote apply all the entries of the remote tx, or nothing. It return
+//errTxExists for txs already applied and errTxDeferred when a conflict is
+//deferred by the resolver. The event has the statements applied
+func (db *SyncDB) applyRemote(ctx context.Context, remote txReg) (ChangeEvent, error) {
+	tx, err := db.beginRemote(ctx, remote)
+	if err == errTxExists {
+		return ChangeEvent{}, err
+	}
+	if err != nil {
+		return ChangeEvent{}, &TxApplyError{TxID: remote.ID, Err: err}
+	}
+
+	for _, tsql := range remote.SQLs {
+		sql := SQLreg{}
+
+		err := json.Unmarshal([]byte(tsql.SQL), &sql)
+		if err != nil {
+			tx.Rollback()
+			return ChangeEvent{}, &TxApplyError{TxID: remote.ID, Statement: SQLreg{SQL: tsql.SQL}, Err: err}
+		}
+
+		n := len(tx.tables)
+		err = tx.applyReg(sql, true)
+		if err == nil {
+			continue
+		}
+		//the rows of the failed statement are rolled back
+		tx.tables = tx.tables[:n]
+		if err == errTxDeferred {
+			tx.Rollback()
+			return ChangeEvent{}, err
+		}
+
+		//the conflicts of changesets are resolved by applyChangeset
+		var c *Conflict
+		if sql.Changeset == nil {
+			c = tx.conflict(remote, sql, err)
+		}
+		if c == nil {
+			tx.Rollback()
+			return ChangeEvent{}, &TxApplyError{TxID: remote.ID, Statement: sql, Err: err}
+		}
+
+		deferred, err := tx.resolve(c)
+		if deferred {
+			tx.Rollback()
+			return ChangeEvent{}, errTxDeferred
+		}
+		if err != nil {
+			tx.Rollback()
+			return ChangeEvent{}, &TxApplyError{TxID: remote.ID, Statement: sql, Err: err}
+		}
+	}
+
+	ev := tx.remoteEvent(remote)
+	err = tx.Commit()
+	if err != nil {
+		return ChangeEvent{}, &TxApplyError{TxID: remote.ID, Err: err}
+	}
+	return ev, nil
+}
+
+//syncRegister apply the txs received from peer, each one all or nothing,
+//with the txs in quarantine. Failed txs go to quarantine, the first error
+//of the txs received is returned
+func (db *SyncDB) syncRegister(ctx context.Context, peer string, txs []txReg) error {
+	return db.applyReceived(ctx, peer, txs, true)
+}
+
+//applyReceived is syncRegister, the txs in quarantine are retried only
+//when retry. The syncs of this node retry them, not the txs sent by peers
+func (db *SyncDB) applyReceived(ctx context.Context, peer string, txs []txReg, retry bool) error {
+	err := db.startApply()
+	if err != nil {
+		return err
+	}
+	defer db.applying.Done()
+
+	peers := map[string]string{}
+	report := map[string]bool{}
 	for _, tx := range txs {
-		func() {
-			log.Println("---->", tx.ID, tx.TxDatetime)
-			err := db.beginWithIDAndDatetime(tx.ID, tx.TxDatetime)
-			if err != nil {
-				log.Println("ERROR in syncregister BEGINTRANS", tx.ID,
-					tx.TxDatetime, err)
+		peers[tx.ID] = peer
+		report[tx.ID] = true
+	}
+
+	if retry {
+		quarantined, err := db.QuarantinedTxs()
+		if err != nil {
+			return err
+		}
+		for _, q := range quarantined {
+			if !report[q.ID] {
+				txs = append(txs, q.tx)
+				peers[q.ID] = q.Peer
 			}
-			defer db.Commit()
+		}
+	}
 
-			for _, tsql := range tx.SQLs {
-				sql := SQLreg{}
+	return db.applyTxs(ctx, txs, peers, report)
+}
 
-				err := json.Unmarshal([]byte(tsql.SQL), &sql)
-				if err != nil {
-					return
-				}
-				err = db.Exec(sql.SQL, sql.Params)
-				if err != nil {
-					log.Println("ERROR in syncregister", sql.SQL,
-						sql.Params, tx.ID, tx.TxDatetime, err)
-				}
+//applyTxs apply the txs in order, the failed ones go to quarantine. It
+//return the first error of the txs in report. When ctx end the tx being
+//applied is rolled back and the others are not applied, they are not
+//quarantined
+func (db *SyncDB) applyTxs(ctx context.Context, txs []txReg, peers map[string]string,
+	report map[string]bool) error {
+	err := db.startApply()
+	if err != nil {
+		return err
+	}
+	defer db.applying.Done()
+
+	//in total order mode, a tx before the last applied one force a rebuild
+	last, late := "", false
+	if db.totalOrder {
+		last, err = db.lastTxKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txOrderKey(txs[i].HLC, txs[i].TxDatetime, txs[i].ID) <
+			txOrderKey(txs[j].HLC, txs[j].TxDatetime, txs[j].ID)
+	})
+
+	var first error
+	for _, tx := range txs {
+		if ctx.Err() != nil {
+			first = ctx.Err()
+			break
+		}
+
+		log.Println("---->", tx.ID, tx.TxDatetime)
+		ev, err := db.applyRemote(ctx, tx)
+		if err != nil && ctx.Err() != nil {
+			first = ctx.Err()
+			break
+		}
+
+		var errq error
+		switch err {
+		case nil, errTxExists:
+			errq = db.unquarantine(tx.ID)
+		default:
+			errq = db.quarantine(tx, peers[tx.ID], err)
+		}
+		if errq != nil {
+			log.Println("ERROR in quarantine", tx.ID, errq)
+		}
+
+		switch err {
+		case nil:
+			db.metrics.inc(&db.metrics.applied)
+			if db.subscribed() {
+				ev.Peer = peers[tx.ID]
+				db.publish(ev)
+			}
+			if db.totalOrder && txOrderKey(tx.HLC, tx.TxDatetime, tx.ID) < last {
+				late = true
 			}
-		}()
+		case errTxExists:
+		case errTxDeferred:
+			log.Println("DEFER in syncregister", tx.ID, tx.TxDatetime)
+		default:
+			db.metrics.inc(&db.metrics.failed)
+			log.Println("ERROR in syncregister", tx.ID, tx.TxDatetime, err)
+			if first == nil && report[tx.ID] {
+				first = err
+			}
+		}
+	}
+
+	if late {
+		err = db.Rebuild()
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return first
 }
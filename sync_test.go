@@ -1,6 +1,14 @@
 package syncdb
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,40 +19,46 @@ const (
 	node2     = "node2"
 )
 
-func TestListTX(t *testing.T) {
-	_, err := discoverNodes("192.168.0.101", idcompany, "12345", node1)
-	if err != nil {
-		t.Error(err)
-	}
-}
-
 func TestSync(t *testing.T) {
 	db1, err := New(":memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db1.Close(context.Background())
 	db1.name = "DB1"
-	db1.Begin()
-	db1.Set("company", "company1")
-	db1.Set("id", "id1")
+	tx, _ := db1.Begin()
+	tx.Set("company", "company1")
+	tx.Set("id", "id1")
 
-	db1.Exec("create table if not exists foo(id integer not null primary key, name text)", []interface{}{})
-	db1.Exec("insert into foo values (NULL, ?)", []interface{}{"teste1"})
-	db1.Exec("insert into foo values (NULL, ?)", []interface{}{"teste2"})
-	db1.Exec("insert into foo values (NULL, ?)", []interface{}{"teste3"})
-	db1.Exec("insert into foo values (NULL, ?)", []interface{}{"teste4"})
+	tx.Exec("create table if not exists foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste1"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste2"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste3"})
+	tx.Exec("insert into foo values (NULL, ?)", []interface{}{"teste4"})
 
-	db1.Commit()
+	tx.Commit()
 
 	db2, err := New(":memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer db2.Close(context.Background())
 	db2.name = "DB2"
-	db2.Begin()
-	db2.Set("company", "company1")
-	db2.Set("id", "id2")
-	db2.Commit()
+	tx, _ = db2.Begin()
+	tx.Set("company", "company1")
+	tx.Set("id", "id2")
+	tx.Commit()
+
+	ips, err := getMyIPs()
+	if err != nil || len(ips) == 0 {
+		t.Fatal("No ip valid", err)
+	}
+	nodes := StaticDiscoverer{
+		"id1": NodeInfo{IP: ips[0], Port: strconv.Itoa(db1.port)},
+		"id2": NodeInfo{IP: ips[0], Port: strconv.Itoa(db2.port)},
+	}
+	db1.Discoverer = nodes
+	db2.Discoverer = nodes
 
 	err = db1.Sync()
 	if err != nil {
@@ -58,8 +72,8 @@ func TestSync(t *testing.T) {
 
 	time.Sleep(10 * time.Second)
 
-	db2.BeginForQuery()
-	rows, _, err := db2.Query("select * from foo", []interface{}{})
+	tx, _ = db2.BeginForQuery()
+	rows, _, err := tx.Query("select * from foo", []interface{}{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -67,7 +81,7 @@ func TestSync(t *testing.T) {
 	if len(rows) != 4 {
 		t.Error("Wrong number of rows")
 	}
-	db2.Commit()
+	tx.Commit()
 }
 
 func TestGetIPS(t *testing.T) {
@@ -85,12 +99,13 @@ func TestGetAllUUIDs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	db1.Begin()
-	db1.Set("company", "company1")
-	db1.Set("id", "id1")
-	db1.Commit()
+	defer db1.Close(context.Background())
+	tx, _ := db1.Begin()
+	tx.Set("company", "company1")
+	tx.Set("id", "id1")
+	tx.Commit()
 
-	uuids, err := db1.getAllUUIDSLocal()
+	uuids, err := db1.getAllUUIDSLocal(false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -99,3 +114,159 @@ func TestGetAllUUIDs(t *testing.T) {
 		t.Error("Wrong number of uuids")
 	}
 }
+
+func TestSyncRegisterAtomic(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	err = db.syncRegister(context.Background(), "", []txReg{remoteTx("tx-create", HLC{Wall: 100}, node2, 1,
+		`{"SQL": "create table foo(id integer not null primary key, name text)"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.syncRegister(context.Background(), "", []txReg{
+		remoteTx("tx-bad", HLC{Wall: 200}, node2, 2,
+			`{"SQL": "insert into foo values (1, 'a')"}`,
+			`{"SQL": "insert into bar values (1)"}`),
+		remoteTx("tx-json", HLC{Wall: 300}, node2, 3,
+			`{"SQL": "insert into foo values (2, 'b')"}`,
+			`{"SQL": `)})
+	applyErr, ok := err.(*TxApplyError)
+	if !ok || applyErr.TxID != "tx-bad" || applyErr.Statement.SQL != "insert into bar values (1)" {
+		t.Fatal("Expected TxApplyError", err)
+	}
+
+	//nothing of the failed txs is written
+	if n := dump(t, db, "select count(*) from foo"); n != `[["0"]]` {
+		t.Error("Partial tx applied", n)
+	}
+	if n := dump(t, db, "select count(*) from __DBTX__ where id <> 'tx-create'"); n != `[["0"]]` {
+		t.Error("Failed tx recorded", n)
+	}
+	quarantined, err := db.QuarantinedTxs()
+	if err != nil || len(quarantined) != 2 {
+		t.Error("Failed txs not kept to retry", quarantined, err)
+	}
+
+	tx, _ := db.Begin()
+	err = tx.Exec("create table bar(id integer not null primary key)", []interface{}{})
+	if err != nil {
+		t.Error(err)
+	}
+	tx.Commit()
+
+	//the failed txs are retried, the retry of tx-json fail again
+	err = db.syncRegister(context.Background(), "", []txReg{})
+	if err != nil {
+		t.Error(err)
+	}
+	if names := fooNames(t, db); names != "a" {
+		t.Error("Wrong names", names)
+	}
+	quarantined, err = db.QuarantinedTxs()
+	if err != nil || len(quarantined) != 1 || quarantined[0].ID != "tx-json" || quarantined[0].Attempts != 2 {
+		t.Error("Wrong quarantine", quarantined, err)
+	}
+}
+
+func TestSyncContext(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{DisableServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	//a hung peer don't block the sync after the deadline
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	u, _ := url.Parse(hung.URL)
+	ip, port, _ := net.SplitHostPort(u.Host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = db.syncWithNode(ctx, ip, port)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Error("Sync not canceled", err, time.Since(start))
+	}
+
+	//the txs of a canceled sync are not applied nor quarantined
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.syncRegister(canceled, "", []txReg{remoteTx("tx-create", HLC{Wall: 100}, node2, 1,
+		`{"SQL": "create table foo(id integer not null primary key, name text)"}`)})
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled", err)
+	}
+	if n := dump(t, db, "select count(*) from __DBTX__"); n != `[["0"]]` {
+		t.Error("Tx applied after cancel", n)
+	}
+	quarantined, err := db.QuarantinedTxs()
+	if err != nil || len(quarantined) != 0 {
+		t.Error("Canceled tx quarantined", quarantined, err)
+	}
+
+	//a write tx wait the current one until the deadline
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = db.BeginCtx(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded", err)
+	}
+	_, _, err = tx.QueryContext(canceled, "select count(*) from __DBTX__", []interface{}{})
+	if err == nil {
+		t.Error("Query with canceled context")
+	}
+	err = tx.ExecContext(context.Background(), "create table foo(id integer not null primary key)",
+		[]interface{}{})
+	if err != nil {
+		t.Error(err)
+	}
+	tx.Commit()
+
+	//the lock is free after the commit
+	tx, err = db.BeginCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+}
+
+func TestDiffsBadMessage(t *testing.T) {
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+
+	res, err := http.Post("http://127.0.0.1:"+strconv.Itoa(db.port)+"/diffs", "application/json",
+		strings.NewReader(`{"IHas": [`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || string(b) != "[]" {
+		t.Error("Wrong response to bad message", res.StatusCode, string(b))
+	}
+
+	//a failure reading the txs is the only response
+	db.sqlite.Exec("ALTER TABLE __DBLOG__ RENAME TO __DBLOG_OLD__")
+	res, err = http.Post("http://127.0.0.1:"+strconv.Itoa(db.port)+"/diffs", "application/json",
+		strings.NewReader(`{"IWant": ["tx-missing"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || string(b) != "[]" {
+		t.Error("Wrong response to failed read", res.StatusCode, string(b))
+	}
+}
@@ -0,0 +1,244 @@
+package syncdb
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+var (
+	errTxExists = errors.New("tx already applied")
+
+	//ErrVectorNotSupported is returned by nodes without version vectors
+	ErrVectorNotSupported = errors.New("node don't support version vectors")
+)
+
+//syncVector is the sync state of a node: the high-water mark of the txs
+//of each origin node, all txs from 1 to the mark were applied, and a hash
+//of the txs created before the origin stamp (legacy txs)
+type syncVector struct {
+	Seqs   map[string]int64
+	Legacy string
+	//ID is the node id, sent by /vector
+	ID string `json:",omitempty"`
+}
+
+//stampTx mark the current tx with this node id, the next sequence and
+//the hybrid logical clock
+func (tx *Tx) stampTx() error {
+	id, err := tx.Get("id")
+	if err != nil {
+		return err
+	}
+
+	//the sequence continue after the pruned txs
+	res, _, err := tx.Query(`SELECT MAX(IFNULL((SELECT MAX(OSEQ) FROM __DBTX__ WHERE ORIGIN = ?1), 0),
+		IFNULL((SELECT OSEQ FROM __DBPRUNED__ WHERE ORIGIN = ?1), 0)) + 1`, []interface{}{id})
+	if err != nil {
+		return err
+	}
+
+	err = tx.ExecWithoutLog("UPDATE __DBTX__ SET ORIGIN = ?, OSEQ = ?, HLC = ? WHERE ID = ?",
+		[]interface{}{id, *res[0][0].(*string), tx.db.clock.Now().String(), tx.idtx})
+	if err != nil {
+		return err
+	}
+
+	return tx.saveClock()
+}
+
+//vector return the sync state of db, it must be in a transaction
+func (tx *Tx) vector() (syncVector, error) {
+	v := syncVector{Seqs: map[string]int64{}}
+
+	//pruned txs are before the mark
+	pruned, err := tx.prunedMarks()
+	if err != nil {
+		return v, err
+	}
+	for origin, seq := range pruned {
+		v.Seqs[origin] = seq
+	}
+
+	res, _, err := tx.Query(`SELECT ORIGIN, MAX(OSEQ), COUNT(*) FROM __DBTX__
+		WHERE ORIGIN IS NOT NULL GROUP BY ORIGIN`, []interface{}{})
+	if err != nil {
+		return v, err
+	}
+
+	for _, row := range res {
+		origin := *row[0].(*string)
+		max, _ := strconv.ParseInt(*row[1].(*string), 10, 64)
+		count, _ := strconv.ParseInt(*row[2].(*string), 10, 64)
+		if max-pruned[origin] == count {
+			v.Seqs[origin] = max
+			continue
+		}
+
+		//there is a gap, the mark is before it
+		seqs, _, err := tx.Query("SELECT OSEQ FROM __DBTX__ WHERE ORIGIN = ? ORDER BY OSEQ",
+			[]interface{}{origin})
+		if err != nil {
+			return v, err
+		}
+		mark := pruned[origin]
+		for _, seq := range seqs {
+			n, _ := strconv.ParseInt(*seq[0].(*string), 10, 64)
+			if n != mark+1 {
+				break
+			}
+			mark = n
+		}
+		v.Seqs[origin] = mark
+	}
+
+	legacy, _, err := tx.Query("SELECT ID FROM __DBTX__ WHERE ORIGIN IS NULL ORDER BY ID", []interface{}{})
+	if err != nil {
+		return v, err
+	}
+	if len(legacy) > 0 {
+		h := sha1.New()
+		for _, row := range legacy {
+			h.Write([]byte(*row[0].(*string)))
+			h.Write([]byte{0})
+		}
+		v.Legacy = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return v, nil
+}
+
+func (db *SyncDB) localVector() (syncVector, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return syncVector{}, err
+	}
+	defer tx.Commit()
+
+	return tx.vector()
+}
+
+//txsSince return the local txs after the high-water marks of vector. It
+//fail with ErrBootstrapRequired when vector is before the pruned txs
+func (db *SyncDB) txsSince(vector map[string]int64) ([]txReg, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	pruned, err := tx.prunedMarks()
+	tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	for origin, mark := range pruned {
+		if vector[origin] < mark {
+			return nil, ErrBootstrapRequired
+		}
+	}
+
+	local, err := db.localVector()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []txReg{}
+	for origin := range local.Seqs {
+		uuids, err := db.originUUIDsAfter(origin, vector[origin])
+		if err != nil {
+			return nil, err
+		}
+
+		txs, err := db.uuids2txRegs(uuids)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, txs...)
+	}
+
+	return ret, nil
+}
+
+func (db *SyncDB) originUUIDsAfter(origin string, seq int64) ([]string, error) {
+	tx, err := db.BeginForQuery()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit()
+
+	res, _, err := tx.Query("SELECT ID FROM __DBTX__ WHERE ORIGIN = ? AND OSEQ > ? ORDER BY OSEQ",
+		[]interface{}{origin, seq})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, val := range res {
+		ret = append(ret, *val[0].(*string))
+	}
+	return ret, nil
+}
+
+func handleVector(w http.ResponseWriter, r *http.Request) {
+	db := r.Context().Value(keyDB).(*SyncDB)
+
+	//404 is for nodes without the endpoint
+	v, err := db.localVector()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	v.ID, err = db.nodeID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getVectorFromNode(ctx context.Context, ip, port string) (syncVector, error) {
+	v := syncVector{}
+	res, err := httpGet(ctx, "http://"+ip+":"+port+"/vector")
+	if err != nil {
+		return v, err
+	}
+
+	text, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return v, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return v, statusError(res, ErrVectorNotSupported)
+	}
+
+	err = json.Unmarshal(text, &v)
+	if err != nil {
+		return v, err
+	}
+
+	return v, nil
+}
+
+//statusError return the error of a response not OK: notSupported when the
+//node don't have the endpoint (404), else the status of the failure
+func statusError(res *http.Response, notSupported error) error {
+	if res.StatusCode == http.StatusNotFound {
+		return notSupported
+	}
+	return errors.New(res.Request.URL.Path + ": " + res.Status)
+}
@@ -0,0 +1,204 @@
+package syncdb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newTestNode(t *testing.T, id string) *SyncDB {
+	db, err := NewWithOptions(":memory:", Options{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := db.Begin()
+	tx.Set("company", idcompany)
+	tx.Set("id", id)
+	tx.Commit()
+	return db
+}
+
+func TestVector(t *testing.T) {
+	db := newTestNode(t, node1)
+	defer db.Close(context.Background())
+
+	tx, _ := db.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	//empty tx don't use a sequence
+	tx, _ = db.Begin()
+	tx.Commit()
+
+	tx, _ = db.Begin()
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	tx, _ = db.Begin()
+	tx.Exec("insert into foo values (2, ?)", []interface{}{"teste2"})
+	tx.Commit()
+
+	v, err := db.localVector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Seqs) != 1 || v.Seqs[node1] != 3 {
+		t.Error("Wrong vector", v.Seqs)
+	}
+	if v.Legacy != "" {
+		t.Error("Unexpected legacy txs", v.Legacy)
+	}
+
+	txs, err := db.txsSince(map[string]int64{node1: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 || txs[0].OSeq != 2 || txs[1].OSeq != 3 {
+		t.Error("Wrong txs since", txs)
+	}
+
+	//a tx after a gap don't move the mark
+	err = db.syncRegister(context.Background(), "", []txReg{{ID: "tx-node2-2", TxDatetime: "2018-11-20 10:00:00",
+		Origin: node2, OSeq: 2,
+		SQLs: []logReg{{SQL: `{"SQL": "insert into foo values (3, 'teste3')"}`}}}})
+	if err != nil {
+		t.Error(err)
+	}
+	v, _ = db.localVector()
+	if v.Seqs[node2] != 0 {
+		t.Error("Wrong mark after gap", v.Seqs)
+	}
+
+	err = db.syncRegister(context.Background(), "", []txReg{{ID: "tx-node2-1", TxDatetime: "2018-11-20 09:00:00",
+		Origin: node2, OSeq: 1,
+		SQLs: []logReg{{SQL: `{"SQL": "insert into foo values (4, 'teste4')"}`}}}})
+	if err != nil {
+		t.Error(err)
+	}
+	v, _ = db.localVector()
+	if v.Seqs[node2] != 2 {
+		t.Error("Wrong mark after fill the gap", v.Seqs)
+	}
+}
+
+func TestSyncVectorRelay(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+	db3 := newTestNode(t, "node3")
+	defer db3.Close(context.Background())
+
+	tx, _ := db1.Begin()
+	tx.Exec("create table foo(id integer not null primary key, name text)", []interface{}{})
+	tx.Exec("insert into foo values (1, ?)", []interface{}{"teste1"})
+	tx.Commit()
+
+	tx, _ = db3.Begin()
+	tx.Exec("create table bar(id integer not null primary key, name text)", []interface{}{})
+	tx.Commit()
+
+	err := db1.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db3.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a repeated sync don't apply anything again
+	err = db3.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db2.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = db3.BeginForQuery()
+	rows, _, err := tx.Query("select name from foo", []interface{}{})
+	tx.Commit()
+	if err != nil || len(rows) != 1 {
+		t.Error("Relayed tx not applied", err)
+	}
+
+	tx, _ = db2.BeginForQuery()
+	rows, _, err = tx.Query("select name from bar", []interface{}{})
+	tx.Commit()
+	if err != nil || len(rows) != 0 {
+		t.Error("Tx from db3 not applied", err)
+	}
+
+	v2, _ := db2.localVector()
+	v3, _ := db3.localVector()
+	for _, v := range []syncVector{v2, v3} {
+		if v.Seqs[node1] != 1 || v.Seqs["node3"] != 1 {
+			t.Error("Wrong vector", v.Seqs)
+		}
+	}
+
+	uuids, _ := db3.getAllUUIDSLocal(false)
+	if len(uuids) != 2 {
+		t.Error("Wrong number of txs", uuids)
+	}
+}
+
+func TestSyncLegacyTxs(t *testing.T) {
+	db1 := newTestNode(t, node1)
+	defer db1.Close(context.Background())
+	db2 := newTestNode(t, node2)
+	defer db2.Close(context.Background())
+
+	//tx received from a node without origin stamp
+	err := db1.syncRegister(context.Background(), "", []txReg{{ID: "tx-legacy", TxDatetime: "2018-11-20 09:00:00",
+		SQLs: []logReg{{SQL: `{"SQL": "create table foo(id integer not null primary key, name text)"}`}}}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	v1, _ := db1.localVector()
+	if v1.Legacy == "" || len(v1.Seqs) != 0 {
+		t.Error("Wrong vector", v1)
+	}
+
+	err = db2.syncWithNode(context.Background(), "127.0.0.1", strconv.Itoa(db1.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2, _ := db2.localVector()
+	if v2.Legacy != v1.Legacy {
+		t.Error("Legacy txs not synced", v1, v2)
+	}
+}
+
+func TestVectorNotSupported(t *testing.T) {
+	status := http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	//only a missing endpoint is a node without vectors
+	_, err := getVectorFromNode(context.Background(), host, port)
+	if err != ErrVectorNotSupported {
+		t.Error("Expected ErrVectorNotSupported", err)
+	}
+	_, err = getBucketsFromNode(context.Background(), host, port, nil, false)
+	if err != ErrReconcileNotSupported {
+		t.Error("Expected ErrReconcileNotSupported", err)
+	}
+
+	status = http.StatusInternalServerError
+	_, err = getVectorFromNode(context.Background(), host, port)
+	if err == nil || err == ErrVectorNotSupported {
+		t.Error("Expected failure of the node", err)
+	}
+	_, err = getBucketsFromNode(context.Background(), host, port, nil, false)
+	if err == nil || err == ErrReconcileNotSupported {
+		t.Error("Expected failure of the node", err)
+	}
+}